@@ -1,16 +1,36 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gold-chen-five/go-reverse-proxy/proxy"
 	"golang.org/x/crypto/acme/autocert"
 )
 
+// How long a removed listener may keep serving in-flight requests after a reload
+const drainTimeout = 30 * time.Second
+
+// How often the setting file is checked for changes
+const watchInterval = 2 * time.Second
+
+type listener struct {
+	server *http.Server
+	ln     net.Listener
+}
+
 func main() {
 	// FILE FLAG
 	flagName := flag.String("file", "setting", "Setting file for proxy")
@@ -30,53 +50,216 @@ func main() {
 		log.Fatalf("Creating server fail: %v", err)
 	}
 
-	// Set up autocert manager for automatic TLS certificates
-	domains := loader.Config.GetAllDomains()
-	certManager := &autocert.Manager{
-		Cache:      autocert.DirCache("certs"),         // Cache certificates on disk
-		Prompt:     autocert.AcceptTOS,                 // Accept Let's Encrypt TOS automatically
-		HostPolicy: autocert.HostWhitelist(domains...), // Replace with your domain(s)
+	// Domains are looked up on every request so reloads are picked up
+	hostPolicy := func(ctx context.Context, host string) error {
+		return autocert.HostWhitelist(loader.GetConfig().GetAllDomains()...)(ctx, host)
+	}
+
+	// Set up autocert manager for automatic TLS certificates. It is replaced
+	// when the acme settings change on reload.
+	acmeConfig := loader.GetConfig().ACME
+	manager, err := proxy.NewCertManager(acmeConfig, hostPolicy)
+	if err != nil {
+		log.Fatalf("Creating cert manager fail: %v", err)
+	}
+	var certManager atomic.Pointer[autocert.Manager]
+	certManager.Store(manager)
+	autocertCertificate := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return certManager.Load().GetCertificate(hello)
 	}
 
+	listeners := make(map[string]*listener)
 	for listen, proxyServer := range proxyServers {
-		if proxyServer.Ssl {
-			go startTLSServer(listen, proxyServer.HttpHandler, certManager)
-		} else {
-			go startServer(listen, proxyServer.HttpHandler)
+		l, err := startListener(listen, proxyServer, loader.TLSConfig(listen, autocertCertificate))
+		if err != nil {
+			log.Fatal(err)
 		}
+		listeners[listen] = l
 	}
 
-	// Redirect HTTP to HTTPS and handle ACME challenges
+	// Metrics are served on their own listener, out of reach of proxied traffic
+	var admin *listener
+	adminListen := adminAddress(loader.GetConfig())
+	if adminListen != "" {
+		admin, err = startHTTP(adminListen, loader.AdminHandler())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Redirect HTTP to HTTPS and handle ACME challenges, autocert redirects
+	// when http_redirect is not configured
+	challengeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		certManager.Load().HTTPHandler(loader.RedirectHandler()).ServeHTTP(w, r)
+	})
+	var challenge *listener
+	challengeListen := loader.GetConfig().ChallengeAddress()
+	if challengeListen != "" {
+		if challenge, err = startHTTP(challengeListen, challengeHandler); err != nil {
+			log.Printf("Starting challenge listener fail: %v", err)
+		}
+	}
+
+	// Reload the setting file on SIGHUP or when it changes on disk
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	changes := proxy.WatchFile(configFileName, watchInterval, nil)
+
+	for {
+		select {
+		case <-hangup:
+		case <-changes:
+		}
+
+		added, removed, err := loader.Reload()
+		if err != nil {
+			log.Printf("Reload config fail, keep serving old config: %v", err)
+			continue
+		}
+
+		for listen := range removed {
+			if l, ok := listeners[listen]; ok {
+				l.drain()
+				delete(listeners, listen)
+			}
+		}
+
+		for listen, proxyServer := range added {
+			l, err := startListener(listen, proxyServer, loader.TLSConfig(listen, autocertCertificate))
+			if err != nil {
+				log.Printf("Starting listener fail: %v", err)
+				loader.DropListener(listen, proxyServer)
+				continue
+			}
+			listeners[listen] = l
+		}
+
+		if listen := adminAddress(loader.GetConfig()); listen != adminListen {
+			if admin != nil {
+				admin.drain()
+				admin = nil
+			}
+			adminListen = listen
+			if listen != "" {
+				if admin, err = startHTTP(listen, loader.AdminHandler()); err != nil {
+					log.Printf("Starting admin listener fail: %v", err)
+				}
+			}
+		}
+
+		if cfg := loader.GetConfig().ACME; !reflect.DeepEqual(cfg, acmeConfig) {
+			manager, err := proxy.NewCertManager(cfg, hostPolicy)
+			if err != nil {
+				log.Printf("Creating cert manager fail, keep the old one: %v", err)
+			} else {
+				certManager.Store(manager)
+				acmeConfig = cfg
+			}
+		}
+
+		if listen := loader.GetConfig().ChallengeAddress(); listen != challengeListen {
+			if challenge != nil {
+				challenge.drain()
+				challenge = nil
+			}
+			challengeListen = listen
+			if listen != "" {
+				if challenge, err = startHTTP(listen, challengeHandler); err != nil {
+					log.Printf("Starting challenge listener fail: %v", err)
+				}
+			}
+		}
+
+		log.Printf("Config reloaded from %s", configFileName)
+	}
+}
+
+func startListener(address string, proxyServer *proxy.TProxyServer, tlsConfig *tls.Config) (*listener, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := newServer(address, proxyServer)
+	if proxyServer.Ssl {
+		return startTLSServer(server, ln, tlsConfig), nil
+	}
+	return startServer(server, ln), nil
+}
+
+// newServer creates the http.Server of a listener with its timeouts
+func newServer(address string, proxyServer *proxy.TProxyServer) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           proxyServer.HttpHandler,
+		ReadHeaderTimeout: proxyServer.Timeouts.ReadHeader,
+		ReadTimeout:       proxyServer.Timeouts.Read,
+		WriteTimeout:      proxyServer.Timeouts.Write,
+		IdleTimeout:       proxyServer.Timeouts.Idle,
+	}
+}
+
+func startTLSServer(server *http.Server, ln net.Listener, tlsConfig *tls.Config) *listener {
+	server.TLSConfig = tlsConfig
+
+	fmt.Printf("HTTPS Server started on %s...\n", server.Addr)
 	go func() {
-		http.ListenAndServe(":80", certManager.HTTPHandler(nil))
+		if err := server.ServeTLS(ln, "", ""); err != nil && !isClosed(err) {
+			log.Printf("HTTPS Server on %s stopped: %v", server.Addr, err)
+		}
 	}()
 
-	select {} // Block forever
+	return &listener{server: server, ln: ln}
 }
 
-func startTLSServer(address string, handler http.Handler, certManager *autocert.Manager) {
-	server := &http.Server{
-		Addr:    address,
-		Handler: handler,
-		TLSConfig: &tls.Config{
-			GetCertificate: certManager.GetCertificate,
-		},
-	}
+func startServer(server *http.Server, ln net.Listener) *listener {
+	fmt.Printf("HTTP Server started on %s...\n", server.Addr)
+	go func() {
+		if err := server.Serve(ln); err != nil && !isClosed(err) {
+			log.Printf("HTTP Server on %s stopped: %v", server.Addr, err)
+		}
+	}()
+
+	return &listener{server: server, ln: ln}
+}
 
-	fmt.Printf("HTTPS Server started on %s...\n", address)
-	if err := server.ListenAndServeTLS("", ""); err != nil {
-		log.Fatal(err)
+// adminAddress returns the admin listen address, empty when there is none
+func adminAddress(cfg *proxy.Config) string {
+	if cfg.Admin == nil {
+		return ""
 	}
+	return cfg.Admin.Listen
 }
 
-func startServer(address string, handler http.Handler) {
-	server := &http.Server{
-		Addr:    address,
-		Handler: handler,
+// startHTTP serves the admin endpoints or the ACME challenges
+func startHTTP(address string, handler http.Handler) (*listener, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
 	}
 
-	fmt.Printf("HTTPS Server started on %s...\n", address)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	server := &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
 	}
+	return startServer(server, ln), nil
+}
+
+// drain stops accepting new connections right away, so the address can be
+// reused, and lets in-flight requests finish in the background
+func (l *listener) drain() {
+	l.ln.Close()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := l.server.Shutdown(ctx); err != nil {
+			log.Printf("Draining %s fail: %v", l.server.Addr, err)
+		}
+	}()
+}
+
+func isClosed(err error) bool {
+	return errors.Is(err, http.ErrServerClosed) || errors.Is(err, net.ErrClosed)
 }
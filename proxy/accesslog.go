@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Access log formats
+const (
+	LogFormatCommon   = "common"
+	LogFormatCombined = "combined"
+	LogFormatJSON     = "json"
+	LogFormatTemplate = "template"
+)
+
+// accessEntry is one line of the access log. The exported fields are what
+// a custom template can use.
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"client_ip"`
+	Host       string    `json:"host"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Protocol   string    `json:"protocol"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	Duration   float64   `json:"duration_ms"`
+	Upstream   string    `json:"upstream"`
+	Route      string    `json:"route"`
+	Retries    int       `json:"retries"`
+	TLSVersion string    `json:"tls_version"`
+	RequestID  string    `json:"request_id"`
+	Referer    string    `json:"referer"`
+	UserAgent  string    `json:"user_agent"`
+}
+
+// accessLogger writes one line per request. It is configured again on every
+// reload, so the handlers can keep the same logger.
+type accessLogger struct {
+	mu       sync.RWMutex
+	cfg      *AccessLogConfig // nil when access logging is off
+	format   string
+	template *template.Template
+	sample   float64
+	out      io.Writer
+	closer   io.Closer // nil for stdout and stderr
+}
+
+func newAccessLogger() *accessLogger {
+	return &accessLogger{}
+}
+
+// validate checks an access log config without opening its output
+func (cfg AccessLogConfig) validate() error {
+	if _, err := cfg.compileTemplate(); err != nil {
+		return err
+	}
+	if cfg.Sample < 0 || cfg.Sample > 1 {
+		return fmt.Errorf("access_log sample must be between 0 and 1")
+	}
+	if cfg.MaxSize < 0 || cfg.MaxAge < 0 || cfg.MaxBackups < 0 {
+		return fmt.Errorf("access_log rotation settings must not be negative")
+	}
+	return nil
+}
+
+func (cfg AccessLogConfig) compileTemplate() (*template.Template, error) {
+	switch cfg.Format {
+	case "", LogFormatCommon, LogFormatCombined, LogFormatJSON:
+		return nil, nil
+	case LogFormatTemplate:
+		if cfg.Template == "" {
+			return nil, fmt.Errorf("access_log format template needs a template")
+		}
+		tmpl, err := template.New("access_log").Parse(cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access_log template: %v", err)
+		}
+		return tmpl, nil
+	default:
+		return nil, fmt.Errorf("unknown access_log format %q", cfg.Format)
+	}
+}
+
+// accessLogSetup is a config of the logger with its output opened, built by
+// prepare and swapped in by apply
+type accessLogSetup struct {
+	cfg      *AccessLogConfig
+	keep     bool // the config did not change, the current output stays
+	format   string
+	template *template.Template
+	sample   float64
+	out      io.Writer
+	closer   io.Closer
+}
+
+// configure switches the logger to cfg, nil turns it off. The output is
+// only reopened when the config changed.
+func (l *accessLogger) configure(cfg *AccessLogConfig) error {
+	setup, err := l.prepare(cfg)
+	if err != nil {
+		return err
+	}
+	l.apply(setup)
+	return nil
+}
+
+// prepare checks cfg and opens its output without changing the logger
+func (l *accessLogger) prepare(cfg *AccessLogConfig) (*accessLogSetup, error) {
+	setup := &accessLogSetup{cfg: cfg}
+	if cfg == nil {
+		return setup, nil
+	}
+
+	l.mu.RLock()
+	setup.keep = l.cfg != nil && *l.cfg == *cfg
+	l.mu.RUnlock()
+	if setup.keep {
+		return setup, nil
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	setup.template, _ = cfg.compileTemplate()
+
+	switch cfg.Output {
+	case "", "stdout":
+		setup.out = os.Stdout
+	case "stderr":
+		setup.out = os.Stderr
+	default:
+		file, err := openRotatingFile(cfg.Output, int64(cfg.MaxSize)<<20, cfg.MaxAge, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		setup.out, setup.closer = file, file
+	}
+
+	setup.format = cfg.Format
+	if setup.format == "" {
+		setup.format = LogFormatCombined
+	}
+	setup.sample = cfg.Sample
+	if setup.sample == 0 {
+		setup.sample = 1
+	}
+	return setup, nil
+}
+
+// apply switches the logger to a prepared setup
+func (l *accessLogger) apply(setup *accessLogSetup) {
+	if setup.keep {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.close()
+	l.cfg = setup.cfg
+	l.format = setup.format
+	l.template = setup.template
+	l.sample = setup.sample
+	l.out = setup.out
+	l.closer = setup.closer
+}
+
+// close closes the current output, l.mu must be held
+func (l *accessLogger) close() {
+	if l.closer != nil {
+		l.closer.Close()
+		l.closer = nil
+	}
+}
+
+// enabled reports whether requests are logged
+func (l *accessLogger) enabled() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cfg != nil
+}
+
+// log writes the line for a finished request. Server errors are logged
+// regardless of sampling.
+func (l *accessLogger) log(r *http.Request, info *requestInfo, status int, bytes int64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.cfg == nil {
+		return
+	}
+	if l.sample < 1 && status < http.StatusInternalServerError && rand.Float64() >= l.sample {
+		return
+	}
+
+	entry := accessEntry{
+		Time:      info.start,
+		ClientIP:  info.clientIP,
+		Host:      info.requestHost,
+		Method:    r.Method,
+		Path:      info.uri,
+		Protocol:  r.Proto,
+		Status:    status,
+		Bytes:     bytes,
+		Duration:  float64(time.Since(info.start).Microseconds()) / 1000,
+		Upstream:  info.upstream,
+		Route:     info.route,
+		Retries:   info.retries,
+		RequestID: info.requestID,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+	if r.TLS != nil {
+		entry.TLSVersion = tls.VersionName(r.TLS.Version)
+	}
+
+	line, err := l.formatEntry(entry)
+	if err != nil {
+		log.Printf("Access log fail: %v", err)
+		return
+	}
+	if _, err := l.out.Write(line); err != nil {
+		log.Printf("Access log fail: %v", err)
+	}
+}
+
+func (l *accessLogger) formatEntry(entry accessEntry) ([]byte, error) {
+	var b bytes.Buffer
+
+	switch l.format {
+	case LogFormatJSON:
+		if err := json.NewEncoder(&b).Encode(entry); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case LogFormatTemplate:
+		if err := l.template.Execute(&b, entry); err != nil {
+			return nil, err
+		}
+		if b.Len() == 0 || b.Bytes()[b.Len()-1] != '\n' {
+			b.WriteByte('\n')
+		}
+		return b.Bytes(), nil
+	}
+
+	// common log format, combined adds the referer and user agent
+	size := "-"
+	if entry.Bytes > 0 {
+		size = strconv.FormatInt(entry.Bytes, 10)
+	}
+	fmt.Fprintf(&b, "%s - - [%s] %q %d %s",
+		dash(entry.ClientIP),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method+" "+entry.Path+" "+entry.Protocol,
+		entry.Status,
+		size,
+	)
+	if l.format == LogFormatCombined {
+		fmt.Fprintf(&b, " %q %q", entry.Referer, entry.UserAgent)
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLogger_Formats(t *testing.T) {
+	entry := accessEntry{
+		Time:       time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		ClientIP:   "192.0.2.1",
+		Host:       "example.com",
+		Method:     "GET",
+		Path:       "/api?x=1",
+		Protocol:   "HTTP/1.1",
+		Status:     200,
+		Bytes:      512,
+		Duration:   1.5,
+		Upstream:   "http://localhost:8081",
+		Route:      "api",
+		TLSVersion: "TLS 1.3",
+		RequestID:  "abc",
+		UserAgent:  "curl/8.0",
+	}
+
+	tests := []struct {
+		cfg  AccessLogConfig
+		want string
+	}{
+		{AccessLogConfig{Format: LogFormatCommon}, `192.0.2.1 - - [01/Mar/2024:12:30:00 +0000] "GET /api?x=1 HTTP/1.1" 200 512` + "\n"},
+		{AccessLogConfig{}, `192.0.2.1 - - [01/Mar/2024:12:30:00 +0000] "GET /api?x=1 HTTP/1.1" 200 512 "" "curl/8.0"` + "\n"},
+		{AccessLogConfig{Format: LogFormatTemplate, Template: "{{.RequestID}} {{.Route}} {{.Upstream}} {{.Status}}"}, "abc api http://localhost:8081 200\n"},
+	}
+
+	for _, tt := range tests {
+		logger := newAccessLogger()
+		assert.NoError(t, logger.configure(&tt.cfg))
+		line, err := logger.formatEntry(entry)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, string(line))
+	}
+
+	logger := newAccessLogger()
+	assert.NoError(t, logger.configure(&AccessLogConfig{Format: LogFormatJSON}))
+	line, err := logger.formatEntry(entry)
+	assert.NoError(t, err)
+	var decoded map[string]interface{}
+	assert.NoError(t, json.Unmarshal(line, &decoded))
+	assert.Equal(t, "api", decoded["route"])
+	assert.Equal(t, "TLS 1.3", decoded["tls_version"])
+	assert.Equal(t, 1.5, decoded["duration_ms"])
+}
+
+func TestAccessLogConfig_Validate(t *testing.T) {
+	assert.Error(t, AccessLogConfig{Format: "apache"}.validate())
+	assert.Error(t, AccessLogConfig{Format: LogFormatTemplate}.validate())
+	assert.Error(t, AccessLogConfig{Format: LogFormatTemplate, Template: "{{.Status"}.validate())
+	assert.Error(t, AccessLogConfig{Sample: 2}.validate())
+	assert.NoError(t, AccessLogConfig{Format: LogFormatJSON, Sample: 0.5}.validate())
+}
+
+func TestConfigLoader_AccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Request-ID", r.Header.Get("X-Request-ID"))
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	output := filepath.Join(t.TempDir(), "access.log")
+	cl := &ConfigLoader{Config: &Config{
+		AccessLog: &AccessLogConfig{Format: LogFormatJSON, Output: output},
+		Servers: []ServerConfig{{
+			Listen: ":8080",
+			Host:   "example.com",
+			Routes: []RouteConfig{
+				{
+					Name: "web", Match: RouteMatch{Path: "/"},
+					Rewrite: RewriteConfig{Host: "backend.internal"},
+					Proxy:   ProxyConfig{Upstream: []string{upstream.URL}},
+				},
+			},
+		}},
+	}}
+	proxyServers, err := cl.CreateProxyServers()
+	assert.NoError(t, err)
+	defer cl.Stop()
+	handler := proxyServers[":8080"].HttpHandler
+
+	req := httptest.NewRequest("GET", "https://example.com/page?q=1", nil)
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13}
+	req.Header.Set("X-Request-ID", "req-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "req-1", rec.Header().Get("X-Seen-Request-ID"), "Expected the request ID to reach the upstream")
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://other.com/", nil))
+
+	data, err := os.ReadFile(output)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+
+	var entry accessEntry
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "/page?q=1", entry.Path)
+	assert.Equal(t, "example.com", entry.Host, "Expected the host the client sent, not the rewritten one")
+	assert.Equal(t, "web", entry.Route)
+	assert.Equal(t, upstream.URL, entry.Upstream)
+	assert.Equal(t, "req-1", entry.RequestID)
+	assert.Equal(t, "TLS 1.3", entry.TLSVersion)
+	assert.Equal(t, http.StatusOK, entry.Status)
+	assert.Equal(t, int64(2), entry.Bytes)
+
+	// unrouted requests are logged too, with a generated ID
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, http.StatusNotFound, entry.Status)
+	assert.Equal(t, "", entry.Route)
+	assert.Len(t, entry.RequestID, 32)
+
+	// sampling drops successful requests but keeps server errors
+	cl.Config.AccessLog = &AccessLogConfig{Format: LogFormatJSON, Output: output, Sample: 1e-9}
+	assert.NoError(t, cl.accessLog.configure(cl.Config.AccessLog))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/fail", nil))
+
+	data, err = os.ReadFile(output)
+	assert.NoError(t, err)
+	lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 3)
+	assert.Contains(t, lines[2], `"status":502`)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := openRotatingFile(path, 10, 0, 2)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := file.Write([]byte("0123456789"))
+		assert.NoError(t, err)
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	assert.Len(t, backups, 2, "Expected only max_backups old files to be kept")
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, "0123456789", string(data))
+
+	// time based rotation
+	file.maxSize = 0
+	file.maxAge = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	file.Write([]byte("new"))
+	data, _ = os.ReadFile(path)
+	assert.Equal(t, "new", string(data))
+}
+
+func TestRotatingFile_RotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := openRotatingFile(path, 10, 0, 0)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	file.Write([]byte("0123456789"))
+
+	// the file is gone, so it can't be moved aside
+	os.Remove(path)
+	_, err = file.Write([]byte("lost"))
+	assert.NoError(t, err, "Expected writes to keep going when rotation fails")
+
+	// rotation is not retried on every write
+	os.WriteFile(path, []byte("0123456789"), 0o644)
+	_, err = file.Write([]byte("old"))
+	assert.NoError(t, err)
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, "0123456789", string(data), "Expected no retry before the interval")
+
+	// but once the retry interval passed
+	file.failed = file.failed.Add(-rotateRetryInterval)
+	_, err = file.Write([]byte("new"))
+	assert.NoError(t, err)
+	data, _ = os.ReadFile(path)
+	assert.Equal(t, "new", string(data))
+	assert.True(t, file.failed.IsZero(), "Expected the failure cleared after rotating")
+}
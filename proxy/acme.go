@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// LetsEncryptStagingURL is the directory of the Let's Encrypt staging CA
+const LetsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// autocert renews this long before expiry by default, and ignores shorter
+// windows than its jitter of an hour
+const (
+	defaultRenewBefore = 30 * 24 * time.Hour
+	minRenewBefore     = time.Hour
+)
+
+func (cfg ACMEConfig) validate() error {
+	if cfg.DirectoryURL != "" {
+		if cfg.Staging {
+			return fmt.Errorf("acme: directory_url and staging are exclusive")
+		}
+		u, err := url.Parse(cfg.DirectoryURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("acme: invalid directory_url %q", cfg.DirectoryURL)
+		}
+	}
+	if cfg.RenewBefore != 0 && cfg.RenewBefore <= minRenewBefore {
+		return fmt.Errorf("acme: renew_before must be longer than %v", minRenewBefore)
+	}
+	if cfg.EAB != nil {
+		if cfg.EAB.KeyID == "" {
+			return fmt.Errorf("acme: eab key_id is required")
+		}
+		if _, err := decodeEABKey(cfg.EAB.HMACKey); err != nil {
+			return err
+		}
+	}
+	if cfg.CAFile != "" {
+		if _, err := loadCertPool(cfg.CAFile); err != nil {
+			return fmt.Errorf("acme: %v", err)
+		}
+	}
+	if cfg.httpChallenge() {
+		if _, _, err := net.SplitHostPort(cfg.challengeListen()); err != nil {
+			return fmt.Errorf("acme: invalid challenge_listen %q", cfg.ChallengeListen)
+		}
+	}
+	return nil
+}
+
+func (cfg ACMEConfig) httpChallenge() bool {
+	return cfg.HTTPChallenge == nil || *cfg.HTTPChallenge
+}
+
+func (cfg ACMEConfig) challengeListen() string {
+	if cfg.ChallengeListen == "" {
+		return ":80"
+	}
+	return cfg.ChallengeListen
+}
+
+// ChallengeAddress returns the plain HTTP listener answering the ACME
+// HTTP-01 challenges and redirecting to HTTPS, empty when it is off
+func (cfg *Config) ChallengeAddress() string {
+	if cfg.ACME != nil && cfg.ACME.httpChallenge() {
+		return cfg.ACME.challengeListen()
+	}
+	if cfg.HTTPRedirect != nil && cfg.HTTPRedirect.Listen != "" {
+		return cfg.HTTPRedirect.Listen
+	}
+	if cfg.ACME == nil || cfg.HTTPRedirect != nil {
+		return ":80"
+	}
+	return ""
+}
+
+// decodeEABKey decodes the HMAC key handed out by the CA, base64url with or
+// without padding
+func decodeEABKey(key string) ([]byte, error) {
+	if key == "" {
+		return nil, fmt.Errorf("acme: eab hmac_key is required")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+	if err != nil {
+		return nil, fmt.Errorf("acme: eab hmac_key is not base64url: %v", err)
+	}
+	return b, nil
+}
+
+// loadCertPool reads PEM CA certificates from paths
+func loadCertPool(paths ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, path := range paths {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", path)
+		}
+	}
+	return pool, nil
+}
+
+// NewCertManager creates the autocert manager issuing certificates for the
+// names hostPolicy allows. A nil cfg uses Let's Encrypt production with the
+// cache in ./certs.
+func NewCertManager(cfg *ACMEConfig, hostPolicy autocert.HostPolicy) (*autocert.Manager, error) {
+	if cfg == nil {
+		cfg = &ACMEConfig{}
+	}
+
+	cacheDir := cfg.CacheDir
+	if cacheDir == "" {
+		cacheDir = "certs"
+	}
+
+	m := &autocert.Manager{
+		Cache:       autocert.DirCache(cacheDir),
+		Prompt:      autocert.AcceptTOS,
+		HostPolicy:  hostPolicy,
+		Email:       cfg.Email,
+		RenewBefore: cfg.RenewBefore,
+		Client:      &acme.Client{DirectoryURL: cfg.DirectoryURL},
+	}
+	if m.RenewBefore == 0 {
+		m.RenewBefore = defaultRenewBefore
+	}
+	if cfg.Staging {
+		m.Client.DirectoryURL = LetsEncryptStagingURL
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("acme: %v", err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		m.Client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	if cfg.EAB != nil {
+		key, err := decodeEABKey(cfg.EAB.HMACKey)
+		if err != nil {
+			return nil, err
+		}
+		m.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: cfg.EAB.KeyID, Key: key}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestNewCertManager(t *testing.T) {
+	m, err := NewCertManager(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, autocert.DirCache("certs"), m.Cache)
+	assert.Equal(t, "", m.Client.DirectoryURL, "Expected the Let's Encrypt production directory")
+	assert.Equal(t, defaultRenewBefore, m.RenewBefore)
+	assert.Nil(t, m.ExternalAccountBinding)
+
+	dir := t.TempDir()
+	caFile, _ := writeTestCert(t, dir, "pebble", "pebble.local")
+	m, err = NewCertManager(&ACMEConfig{
+		DirectoryURL: "https://localhost:14000/dir",
+		Email:        "ops@example.com",
+		CacheDir:     filepath.Join(dir, "acme"),
+		RenewBefore:  14 * 24 * time.Hour,
+		CAFile:       caFile,
+		EAB:          &EABConfig{KeyID: "kid-1", HMACKey: "c2VjcmV0LWtleQ"},
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://localhost:14000/dir", m.Client.DirectoryURL)
+	assert.Equal(t, "ops@example.com", m.Email)
+	assert.Equal(t, autocert.DirCache(filepath.Join(dir, "acme")), m.Cache)
+	assert.Equal(t, 14*24*time.Hour, m.RenewBefore)
+	assert.NotNil(t, m.Client.HTTPClient, "Expected a client trusting the CA file")
+	assert.Equal(t, "kid-1", m.ExternalAccountBinding.KID)
+	assert.Equal(t, []byte("secret-key"), m.ExternalAccountBinding.Key)
+
+	m, err = NewCertManager(&ACMEConfig{Staging: true}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, LetsEncryptStagingURL, m.Client.DirectoryURL)
+}
+
+func TestACMEConfig_Validate(t *testing.T) {
+	off := false
+	emptyCA := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(emptyCA, []byte("no pem here"), 0o600)
+
+	assert.NoError(t, ACMEConfig{DirectoryURL: "https://acme.example.com/directory", HTTPChallenge: &off}.validate())
+	assert.NoError(t, ACMEConfig{EAB: &EABConfig{KeyID: "kid", HMACKey: "c2VjcmV0LWtleQ=="}}.validate())
+
+	tests := []ACMEConfig{
+		{DirectoryURL: "acme.example.com"},
+		{DirectoryURL: "https://acme.example.com/directory", Staging: true},
+		{RenewBefore: time.Minute},
+		{EAB: &EABConfig{HMACKey: "c2VjcmV0"}},
+		{EAB: &EABConfig{KeyID: "kid", HMACKey: "not base64!"}},
+		{CAFile: emptyCA},
+		{ChallengeListen: "80"},
+	}
+	for i, cfg := range tests {
+		assert.Error(t, cfg.validate(), "case %d", i)
+	}
+}
+
+func TestConfig_ChallengeAddress(t *testing.T) {
+	off := false
+	route := []RouteConfig{{Match: RouteMatch{Path: "/"}, Proxy: ProxyConfig{Upstream: []string{"http://localhost:8081"}}}}
+
+	cfg := &Config{Servers: []ServerConfig{{Listen: ":80", Host: "example.com", Routes: route}}}
+	assert.Equal(t, ":80", cfg.ChallengeAddress())
+	assert.NoError(t, cfg.Validate(), "Expected configs without acme to keep working")
+
+	cfg.ACME = &ACMEConfig{}
+	assert.Error(t, cfg.Validate(), "Expected the challenge listener to clash with the server")
+
+	cfg.ACME = &ACMEConfig{ChallengeListen: ":8081"}
+	assert.Equal(t, ":8081", cfg.ChallengeAddress())
+	assert.NoError(t, cfg.Validate())
+
+	cfg.ACME = &ACMEConfig{HTTPChallenge: &off}
+	assert.Equal(t, "", cfg.ChallengeAddress())
+	assert.NoError(t, cfg.Validate())
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// Defaults for request buffering when the config leaves a field empty
+const (
+	defaultBufferMaxBytes    = 10 << 20
+	defaultBufferMemoryBytes = 1 << 20
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// bodyBuffer reads request bodies completely before they are proxied so
+// they can be replayed on retries. Bodies above memoryBytes spill to a
+// temporary file.
+type bodyBuffer struct {
+	maxBytes    int64
+	memoryBytes int64
+	tempDir     string
+}
+
+func newBodyBuffer(cfg BufferConfig) (*bodyBuffer, error) {
+	b := &bodyBuffer{
+		maxBytes:    cfg.MaxBytes,
+		memoryBytes: cfg.MemoryBytes,
+		tempDir:     cfg.TempDir,
+	}
+
+	if b.maxBytes <= 0 {
+		b.maxBytes = defaultBufferMaxBytes
+	}
+	if b.memoryBytes <= 0 {
+		b.memoryBytes = defaultBufferMemoryBytes
+	}
+	if b.memoryBytes > b.maxBytes {
+		b.memoryBytes = b.maxBytes
+	}
+	if b.tempDir != "" {
+		if info, err := os.Stat(b.tempDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("buffer temp_dir %s is not a directory", b.tempDir)
+		}
+	}
+
+	return b, nil
+}
+
+// buffer replaces the body of r with a replayable copy and sets GetBody.
+// The returned cleanup removes any temporary file once the request is done.
+func (b *bodyBuffer) buffer(r *http.Request) (cleanup func(), err error) {
+	cleanup = func() {}
+	if r.Body == nil || r.Body == http.NoBody {
+		return cleanup, nil
+	}
+	if r.ContentLength > b.maxBytes {
+		return cleanup, errBodyTooLarge
+	}
+	defer r.Body.Close()
+
+	var mem bytes.Buffer
+	n, err := io.Copy(&mem, io.LimitReader(r.Body, b.memoryBytes+1))
+	if err != nil {
+		return cleanup, err
+	}
+
+	if n <= b.memoryBytes {
+		data := mem.Bytes()
+		setReplayableBody(r, int64(len(data)), func() io.ReadCloser {
+			return io.NopCloser(bytes.NewReader(data))
+		})
+		return cleanup, nil
+	}
+
+	// spill to disk, the part already read goes first
+	file, err := os.CreateTemp(b.tempDir, "proxy-body-*")
+	if err != nil {
+		return cleanup, err
+	}
+	cleanup = func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	if _, err := file.Write(mem.Bytes()); err != nil {
+		cleanup()
+		return func() {}, err
+	}
+	rest, err := io.Copy(file, io.LimitReader(r.Body, b.maxBytes-n+1))
+	if err != nil {
+		cleanup()
+		return func() {}, err
+	}
+
+	size := n + rest
+	if size > b.maxBytes {
+		cleanup()
+		return func() {}, errBodyTooLarge
+	}
+
+	setReplayableBody(r, size, func() io.ReadCloser {
+		return io.NopCloser(io.NewSectionReader(file, 0, size))
+	})
+	return cleanup, nil
+}
+
+func setReplayableBody(r *http.Request, size int64, open func() io.ReadCloser) {
+	r.Body = open()
+	r.ContentLength = size
+	r.TransferEncoding = nil
+	r.GetBody = func() (io.ReadCloser, error) {
+		return open(), nil
+	}
+}
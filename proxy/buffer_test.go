@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyServer_BufferReplaysBody(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer echo.Close()
+
+	for _, memoryBytes := range []int64{1024, 4} {
+		tempDir := t.TempDir()
+		proxyServer := newRetryProxy(t, RetryConfig{Attempts: 2, RetryNonIdempotent: true}, unavailable.URL, echo.URL)
+		assert.NoError(t, proxyServer.SetBuffer(BufferConfig{MemoryBytes: memoryBytes, TempDir: tempDir}))
+
+		for i := 0; i < 4; i++ {
+			rr := httptest.NewRecorder()
+			proxyServer.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost", strings.NewReader("payload")))
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "payload", rr.Body.String())
+		}
+
+		// spilled bodies are removed once the request is done
+		entries, err := os.ReadDir(tempDir)
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+	}
+}
+
+func TestProxyServer_BufferTooLarge(t *testing.T) {
+	var called bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer upstream.Close()
+
+	proxyServer, err := NewProxyServer([]string{upstream.URL})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	assert.NoError(t, proxyServer.SetBuffer(BufferConfig{MaxBytes: 8, MemoryBytes: 4, TempDir: t.TempDir()}))
+
+	// a known length is rejected up front
+	rr := httptest.NewRecorder()
+	proxyServer.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost", strings.NewReader("0123456789")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	// a chunked body is rejected once it grows past the limit
+	req := httptest.NewRequest("POST", "http://localhost", io.NopCloser(strings.NewReader("0123456789")))
+	req.ContentLength = -1
+	rr = httptest.NewRecorder()
+	proxyServer.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.False(t, called, "Expected oversized bodies to never reach the upstream")
+
+	rr = httptest.NewRecorder()
+	proxyServer.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost", strings.NewReader("01234567")))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -0,0 +1,326 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often certificate files are checked for changes, at most once per
+// handshake
+const certCheckInterval = 2 * time.Second
+
+// GetCertificateFunc is the signature of tls.Config.GetCertificate
+type GetCertificateFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// certStore holds the static certificates and client auth settings of every
+// TLS listener
+type certStore struct {
+	mu        sync.RWMutex
+	listeners map[string]*certRouter
+	files     map[string]*certFile // by cert and key path, kept across reloads
+}
+
+func newCertStore() *certStore {
+	return &certStore{
+		listeners: make(map[string]*certRouter),
+		files:     make(map[string]*certFile),
+	}
+}
+
+// certRouter picks the server of a listener by SNI name, in the order the
+// host router picks it by Host
+type certRouter struct {
+	exact      map[string]*tlsSite
+	wildcards  []certPattern
+	regexes    []certPattern
+	fallback   *tlsSite
+	hasDefault bool
+	policy     *tlsPolicy // nil keeps Go's defaults
+}
+
+type certPattern struct {
+	suffix string
+	regex  *regexp.Regexp
+	site   *tlsSite
+}
+
+// tlsSite is the TLS side of a server
+type tlsSite struct {
+	cert       *certFile   // nil leaves the names to the fallback
+	clientAuth *clientAuth // nil when clients are not asked for a certificate
+}
+
+// certFile is a key pair loaded from disk and loaded again when either file
+// changes
+type certFile struct {
+	certPath string
+	keyPath  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+// loadKeyPair loads a certificate, with its chain, and checks the key matches
+func loadKeyPair(certPath, keyPath string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key pair cert_file %s, key_file %s: %v", certPath, keyPath, err)
+	}
+	return &cert, nil
+}
+
+func openCertFile(certPath, keyPath string) (*certFile, error) {
+	f := &certFile{certPath: certPath, keyPath: keyPath}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	f.checked = time.Now()
+	return f, nil
+}
+
+// load reads the key pair if either file changed since it was last loaded
+func (f *certFile) load() error {
+	certInfo, err := os.Stat(f.certPath)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(f.keyPath)
+	if err != nil {
+		return err
+	}
+	if f.cert != nil && certInfo.ModTime().Equal(f.certMod) && keyInfo.ModTime().Equal(f.keyMod) {
+		return nil
+	}
+
+	// a pair caught half written fails to load and is tried again on the
+	// next check
+	cert, err := loadKeyPair(f.certPath, f.keyPath)
+	if err != nil {
+		return err
+	}
+	f.cert = cert
+	f.certMod = certInfo.ModTime()
+	f.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+// get returns the certificate, reloading it first when the files changed
+func (f *certFile) get() *tls.Certificate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.checked) >= certCheckInterval {
+		f.checked = time.Now()
+		if err := f.load(); err != nil {
+			log.Printf("Reloading certificate %s fail, keep serving the old one: %v", f.certPath, err)
+		}
+	}
+	return f.cert
+}
+
+// certSet is the TLS side of a config, built by prepare and swapped in by
+// swap
+type certSet struct {
+	listeners map[string]*certRouter
+	files     map[string]*certFile
+}
+
+// update loads the certificate files and client auth settings of cfg and
+// swaps them in. On error the current settings keep serving.
+func (s *certStore) update(cfg *Config) error {
+	set, err := s.prepare(cfg)
+	if err != nil {
+		return err
+	}
+	s.swap(set)
+	return nil
+}
+
+// prepare loads the certificate files and client auth settings of cfg
+// without changing the store. Certificate files that did not change path
+// are not read again.
+func (s *certStore) prepare(cfg *Config) (*certSet, error) {
+	s.mu.RLock()
+	previous := s.files
+	s.mu.RUnlock()
+
+	listeners := make(map[string]*certRouter)
+	files := make(map[string]*certFile)
+
+	for _, server := range cfg.Servers {
+		if !server.Ssl {
+			continue
+		}
+
+		site := &tlsSite{}
+		if server.CertFile != "" {
+			key := server.CertFile + "|" + server.KeyFile
+			file := files[key]
+			if file == nil {
+				file = previous[key]
+			}
+			if file == nil {
+				var err error
+				if file, err = openCertFile(server.CertFile, server.KeyFile); err != nil {
+					return nil, err
+				}
+			}
+			files[key] = file
+			site.cert = file
+		}
+		if server.ClientAuth != nil {
+			ca, err := newClientAuth(*server.ClientAuth)
+			if err != nil {
+				return nil, err
+			}
+			site.clientAuth = ca
+		}
+
+		cr, ok := listeners[server.Listen]
+		if !ok {
+			cr = &certRouter{exact: make(map[string]*tlsSite)}
+			listeners[server.Listen] = cr
+		}
+		if server.TLS != nil && cr.policy == nil {
+			policy, err := newTLSPolicy(*server.TLS)
+			if err != nil {
+				return nil, err
+			}
+			cr.policy = policy
+		}
+		if err := cr.add(server.HostNames(), server.Default, site); err != nil {
+			return nil, err
+		}
+	}
+
+	return &certSet{listeners: listeners, files: files}, nil
+}
+
+// swap switches the store to a prepared set
+func (s *certStore) swap(set *certSet) {
+	s.mu.Lock()
+	s.listeners = set.listeners
+	s.files = set.files
+	s.mu.Unlock()
+}
+
+// getCertificate returns the GetCertificate of a listener. Names without a
+// static certificate are handed to fallback, which may be nil.
+func (s *certStore) getCertificate(listen string, fallback GetCertificateFunc) GetCertificateFunc {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		s.mu.RLock()
+		cr := s.listeners[listen]
+		s.mu.RUnlock()
+
+		if cr != nil {
+			if site, ok := cr.lookup(hello.ServerName); ok && site.cert != nil {
+				return site.cert.get(), nil
+			}
+		}
+		if fallback == nil {
+			return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+		}
+		return fallback(hello)
+	}
+}
+
+// getConfigForClient returns the tls.Config GetConfigForClient of a
+// listener. It applies the TLS policy of the listener and asks for client
+// certificates on the servers that want them.
+func (s *certStore) getConfigForClient(listen string, base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		s.mu.RLock()
+		cr := s.listeners[listen]
+		s.mu.RUnlock()
+
+		if cr == nil {
+			return nil, nil
+		}
+
+		config := base
+		if cr.policy != nil {
+			config = cr.policy.tlsConfig(base)
+		}
+		if site, ok := cr.lookup(hello.ServerName); ok && site.clientAuth != nil {
+			config = site.clientAuth.tlsConfig(config)
+		}
+		if cr.policy != nil && cr.policy.tickets != nil {
+			cr.policy.tickets.apply(config)
+		}
+
+		if config == base {
+			return nil, nil
+		}
+		return config, nil
+	}
+}
+
+// add registers the server under every name
+func (cr *certRouter) add(names []string, isDefault bool, site *tlsSite) error {
+	for _, name := range names {
+		switch {
+		case isRegexHost(name):
+			re, err := compileHostRegex(name)
+			if err != nil {
+				return err
+			}
+			cr.regexes = append(cr.regexes, certPattern{regex: re, site: site})
+		case isWildcardHost(name):
+			cr.wildcards = append(cr.wildcards, certPattern{suffix: normalizeHost(name[1:]), site: site})
+		default:
+			cr.exact[normalizeHost(name)] = site
+		}
+	}
+
+	if isDefault {
+		cr.fallback = site
+		cr.hasDefault = true
+	}
+
+	sort.SliceStable(cr.wildcards, func(i, j int) bool {
+		return len(cr.wildcards[i].suffix) > len(cr.wildcards[j].suffix)
+	})
+	return nil
+}
+
+// lookup returns the server for an SNI name, clients sending none get the
+// default server
+func (cr *certRouter) lookup(name string) (*tlsSite, bool) {
+	if site, ok := cr.match(name); ok {
+		return site, true
+	}
+	return cr.fallback, cr.hasDefault
+}
+
+// match returns the server configured for name, without the default server
+func (cr *certRouter) match(name string) (*tlsSite, bool) {
+	name = normalizeHost(name)
+	if name == "" {
+		return nil, false
+	}
+
+	if site, ok := cr.exact[name]; ok {
+		return site, true
+	}
+	for _, p := range cr.wildcards {
+		if strings.HasSuffix(name, p.suffix) && len(name) > len(p.suffix) {
+			return p.site, true
+		}
+	}
+	for _, p := range cr.regexes {
+		if p.regex.MatchString(name) {
+			return p.site, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCert writes a self-signed key pair for names to dir
+func writeTestCert(t *testing.T, dir, name string, names ...string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certPath, keyPath
+}
+
+func certName(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertStore_SNI(t *testing.T) {
+	dir := t.TempDir()
+	aCert, aKey := writeTestCert(t, dir, "a", "a.example.com")
+	bCert, bKey := writeTestCert(t, dir, "b", "*.b.example.com")
+
+	route := []RouteConfig{{Match: RouteMatch{Path: "/"}, Proxy: ProxyConfig{Upstream: []string{"http://localhost:8081"}}}}
+	cfg := &Config{Servers: []ServerConfig{
+		{Listen: ":443", Ssl: true, Host: "a.example.com", Default: true, CertFile: aCert, KeyFile: aKey, Routes: route},
+		{Listen: ":443", Ssl: true, Host: "*.b.example.com", CertFile: bCert, KeyFile: bKey, Routes: route},
+		{Listen: ":443", Ssl: true, Host: "c.example.com", Routes: route},
+	}}
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, []string{"c.example.com"}, cfg.GetAllDomains(), "Expected only autocert names whitelisted")
+
+	store := newCertStore()
+	assert.NoError(t, store.update(cfg))
+
+	errFallback := errors.New("autocert")
+	getCertificate := store.getCertificate(":443", func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return nil, errFallback
+	})
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"a.example.com", "a.example.com"},
+		{"A.Example.com", "a.example.com"},
+		{"x.b.example.com", "*.b.example.com"},
+		{"unknown.example.com", "a.example.com"},
+		{"", "a.example.com"},
+	}
+	for _, tt := range tests {
+		cert, err := getCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		assert.NoError(t, err, tt.serverName)
+		assert.Equal(t, tt.want, certName(t, cert), tt.serverName)
+	}
+
+	_, err := getCertificate(&tls.ClientHelloInfo{ServerName: "c.example.com"})
+	assert.ErrorIs(t, err, errFallback, "Expected names without a static certificate to go to autocert")
+
+	_, err = store.getCertificate(":8443", nil)(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	assert.Error(t, err, "Expected no certificate on another listener")
+}
+
+func TestCertStore_ReloadOnChange(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestCert(t, dir, "site", "old.example.com")
+
+	cfg := &Config{Servers: []ServerConfig{
+		{Listen: ":443", Ssl: true, Host: "example.com", Default: true, CertFile: certPath, KeyFile: keyPath},
+	}}
+	store := newCertStore()
+	assert.NoError(t, store.update(cfg))
+	getCertificate := store.getCertificate(":443", nil)
+
+	cert, _ := getCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.Equal(t, "old.example.com", certName(t, cert))
+
+	// replace the pair on disk, then let the check interval pass
+	writeTestCert(t, dir, "site", "new.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	os.Chtimes(keyPath, later, later)
+	file := store.files[certPath+"|"+keyPath]
+	file.checked = time.Time{}
+
+	cert, _ = getCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.Equal(t, "new.example.com", certName(t, cert))
+
+	// a broken pair keeps the last good one
+	os.WriteFile(keyPath, []byte("garbage"), 0o600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyPath, later, later)
+	file.checked = time.Time{}
+
+	cert, _ = getCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.Equal(t, "new.example.com", certName(t, cert))
+
+	// a reload with the same files reuses them
+	assert.NoError(t, store.update(cfg))
+	assert.Same(t, file, store.files[certPath+"|"+keyPath])
+}
+
+func TestValidate_CertFiles(t *testing.T) {
+	dir := t.TempDir()
+	aCert, _ := writeTestCert(t, dir, "a", "a.example.com")
+	_, bKey := writeTestCert(t, dir, "b", "b.example.com")
+
+	route := []RouteConfig{{Match: RouteMatch{Path: "/"}, Proxy: ProxyConfig{Upstream: []string{"http://localhost:8081"}}}}
+	tests := []ServerConfig{
+		{Listen: ":443", Ssl: true, Host: "a.example.com", CertFile: aCert, KeyFile: bKey, Routes: route},
+		{Listen: ":443", Ssl: true, Host: "a.example.com", CertFile: aCert, Routes: route},
+		{Listen: ":443", Ssl: true, Host: "a.example.com", CertFile: filepath.Join(dir, "missing.crt"), KeyFile: bKey, Routes: route},
+		{Listen: ":80", Host: "a.example.com", CertFile: aCert, KeyFile: bKey, Routes: route},
+	}
+	for i, server := range tests {
+		cfg := &Config{Servers: []ServerConfig{server}}
+		assert.Error(t, cfg.Validate(), "case %d", i)
+	}
+}
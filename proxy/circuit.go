@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of the circuit breaker of an upstream server
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"    // traffic flows
+	CircuitOpen     CircuitState = "open"      // the server gets no traffic
+	CircuitHalfOpen CircuitState = "half-open" // a few probe requests decide whether to close
+)
+
+// Defaults for circuit breakers when the config leaves a field empty
+const (
+	defaultCircuitWindow           = 10 * time.Second
+	defaultCircuitMinRequests      = 20
+	defaultCircuitErrorPercent     = 50
+	defaultCircuitSlowPercent      = 50
+	defaultCircuitOpenDuration     = 30 * time.Second
+	defaultCircuitHalfOpenRequests = 3
+	circuitBuckets                 = 10
+)
+
+// circuitBreaker holds the thresholds of a route, the state lives on each
+// upstream server so it survives reloads
+type circuitBreaker struct {
+	window           time.Duration
+	minRequests      int
+	errorPercent     int
+	slowCall         time.Duration // 0 turns off the latency threshold
+	slowPercent      int
+	openDuration     time.Duration
+	halfOpenRequests int
+}
+
+func newCircuitBreaker(cfg CircuitBreakerConfig) *circuitBreaker {
+	cb := &circuitBreaker{
+		window:           cfg.Window,
+		minRequests:      cfg.MinRequests,
+		errorPercent:     cfg.ErrorPercent,
+		slowCall:         cfg.SlowCall,
+		slowPercent:      cfg.SlowPercent,
+		openDuration:     cfg.OpenDuration,
+		halfOpenRequests: cfg.HalfOpenRequests,
+	}
+
+	if cb.window <= 0 {
+		cb.window = defaultCircuitWindow
+	}
+	if cb.minRequests <= 0 {
+		cb.minRequests = defaultCircuitMinRequests
+	}
+	if cb.errorPercent <= 0 {
+		cb.errorPercent = defaultCircuitErrorPercent
+	}
+	if cb.slowPercent <= 0 {
+		cb.slowPercent = defaultCircuitSlowPercent
+	}
+	if cb.openDuration <= 0 {
+		cb.openDuration = defaultCircuitOpenDuration
+	}
+	if cb.halfOpenRequests <= 0 {
+		cb.halfOpenRequests = defaultCircuitHalfOpenRequests
+	}
+
+	return cb
+}
+
+// circuitBucket counts the requests of one slice of the rolling window
+type circuitBucket struct {
+	slot   int64
+	total  int
+	errors int
+	slow   int
+}
+
+// circuit is the circuit breaker state of one upstream server
+type circuit struct {
+	mu         sync.Mutex
+	state      CircuitState // "" is closed
+	openUntil  time.Time
+	probes     int // half-open requests in flight
+	probeLimit int
+	successes  int // half-open requests that passed
+	buckets    [circuitBuckets]circuitBucket
+}
+
+// refresh moves an open circuit to half-open once its open time is over
+func (c *circuit) refresh(server *UpstreamServer) {
+	if c.state == CircuitOpen && !time.Now().Before(c.openUntil) {
+		c.state = CircuitHalfOpen
+		c.probes = 0
+		c.successes = 0
+		log.Printf("Circuit %s half-open", server.URL)
+	}
+}
+
+// CircuitState returns the state of the server's circuit breaker
+func (s *UpstreamServer) CircuitState() CircuitState {
+	c := &s.circuit
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.refresh(s)
+	if c.state == "" {
+		return CircuitClosed
+	}
+	return c.state
+}
+
+// circuitAvailable reports whether the circuit lets a request through,
+// without taking a half-open probe
+func (s *UpstreamServer) circuitAvailable() bool {
+	c := &s.circuit
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.refresh(s)
+	switch c.state {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		return c.probes < c.probeLimit
+	}
+	return true
+}
+
+// allow lets a request through to server. In half-open state it takes one
+// of the probes and reports so.
+func (cb *circuitBreaker) allow(server *UpstreamServer) (probe bool, ok bool) {
+	c := &server.circuit
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.refresh(server)
+	switch c.state {
+	case CircuitOpen:
+		return false, false
+	case CircuitHalfOpen:
+		if c.probes >= c.probeLimit {
+			return false, false
+		}
+		c.probes++
+		return true, true
+	}
+	return false, true
+}
+
+// record feeds the outcome of one request to server. A request the client
+// cancelled only gives back its probe.
+func (cb *circuitBreaker) record(server *UpstreamServer, probe bool, failed bool, latency time.Duration, cancelled bool) {
+	c := &server.circuit
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if probe && c.state == CircuitHalfOpen {
+		c.probes--
+	}
+	if cancelled {
+		return
+	}
+
+	slow := cb.slowCall > 0 && latency >= cb.slowCall
+
+	if probe && c.state == CircuitHalfOpen {
+		if failed || slow {
+			cb.open(server, "probe failed")
+			return
+		}
+		c.successes++
+		if c.successes >= c.probeLimit {
+			c.state = CircuitClosed
+			c.buckets = [circuitBuckets]circuitBucket{}
+			log.Printf("Circuit %s closed", server.URL)
+		}
+		return
+	}
+
+	// rolling window of circuitBuckets slices
+	width := int64(cb.window / circuitBuckets)
+	if width <= 0 {
+		width = 1
+	}
+	slot := time.Now().UnixNano() / width
+	bucket := &c.buckets[slot%circuitBuckets]
+	if bucket.slot != slot {
+		*bucket = circuitBucket{slot: slot}
+	}
+	bucket.total++
+	if failed {
+		bucket.errors++
+	}
+	if slow {
+		bucket.slow++
+	}
+
+	if c.state == CircuitOpen || c.state == CircuitHalfOpen {
+		return
+	}
+
+	var total, errors, slowCalls int
+	for _, b := range c.buckets {
+		if slot-b.slot < circuitBuckets {
+			total += b.total
+			errors += b.errors
+			slowCalls += b.slow
+		}
+	}
+	if total < cb.minRequests {
+		return
+	}
+
+	switch {
+	case errors*100 >= total*cb.errorPercent:
+		cb.open(server, "error rate")
+	case cb.slowCall > 0 && slowCalls*100 >= total*cb.slowPercent:
+		cb.open(server, "slow call rate")
+	}
+}
+
+// open trips the circuit, c.mu must be held
+func (cb *circuitBreaker) open(server *UpstreamServer, reason string) {
+	c := &server.circuit
+	c.state = CircuitOpen
+	c.openUntil = time.Now().Add(cb.openDuration)
+	c.probeLimit = cb.halfOpenRequests
+	c.buckets = [circuitBuckets]circuitBucket{}
+	log.Printf("Circuit %s open for %v: %s", server.URL, cb.openDuration, reason)
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyServer_CircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer flaky.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	proxyServer, err := NewProxyServer([]string{flaky.URL, healthy.URL})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	proxyServer.SetCircuitBreaker(CircuitBreakerConfig{MinRequests: 4, HalfOpenRequests: 2})
+	bad := proxyServer.LoadBalancer.servers[0]
+
+	for i := 0; i < 8; i++ {
+		proxyServer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost", nil))
+	}
+	assert.Equal(t, CircuitOpen, bad.CircuitState())
+	assert.True(t, bad.IsAlive(), "Expected the circuit to leave active health state alone")
+
+	for i := 0; i < 4; i++ {
+		rr := httptest.NewRecorder()
+		proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	// a failed probe opens the circuit again
+	bad.circuit.openUntil = time.Now()
+	assert.Equal(t, CircuitHalfOpen, bad.CircuitState())
+	for i := 0; i < 2; i++ {
+		proxyServer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost", nil))
+	}
+	assert.Equal(t, CircuitOpen, bad.CircuitState())
+
+	// enough passed probes close it
+	failing.Store(false)
+	bad.circuit.openUntil = time.Now()
+	for i := 0; i < 4; i++ {
+		proxyServer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost", nil))
+	}
+	assert.Equal(t, CircuitClosed, bad.CircuitState())
+}
+
+func TestCircuitBreaker_SlowCalls(t *testing.T) {
+	servers := newTestUpstreams(1)
+	cb := newCircuitBreaker(CircuitBreakerConfig{MinRequests: 4, SlowCall: 100 * time.Millisecond})
+
+	for i := 0; i < 3; i++ {
+		cb.record(servers[0], false, false, 10*time.Millisecond, false)
+		cb.record(servers[0], false, false, time.Second, false)
+	}
+	assert.Equal(t, CircuitOpen, servers[0].CircuitState())
+	assert.Empty(t, getAliveServers(servers))
+}
+
+func TestCircuitBreaker_HalfOpenProbes(t *testing.T) {
+	servers := newTestUpstreams(1)
+	server := servers[0]
+	cb := newCircuitBreaker(CircuitBreakerConfig{HalfOpenRequests: 2})
+
+	cb.open(server, "test")
+	_, ok := cb.allow(server)
+	assert.False(t, ok, "Expected an open circuit to reject requests")
+
+	server.circuit.openUntil = time.Now()
+	for i := 0; i < 2; i++ {
+		probe, ok := cb.allow(server)
+		assert.True(t, ok)
+		assert.True(t, probe)
+	}
+	_, ok = cb.allow(server)
+	assert.False(t, ok, "Expected no more probes than half_open_requests")
+	assert.False(t, server.circuitAvailable())
+
+	// a probe the client cancelled is given back without counting
+	cb.record(server, true, false, 0, true)
+	assert.True(t, server.circuitAvailable())
+	assert.Equal(t, CircuitHalfOpen, server.CircuitState())
+}
@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Client auth modes
+const (
+	ClientAuthNone    = "none"    // no certificate is asked for
+	ClientAuthRequest = "request" // asked for, not required or verified
+	ClientAuthRequire = "require" // required, not verified
+	ClientAuthVerify  = "verify"  // required and verified against the CA files
+)
+
+// Headers carrying the verified client certificate upstream when none are
+// configured
+var defaultClientCertHeaders = map[string]string{
+	"X-Client-Cert-Subject": "${client_cert_subject}",
+	"X-Client-Cert":         "${client_cert}",
+}
+
+var errClientCertDenied = errors.New("client certificate not allowed")
+
+// clientAuth are the compiled ClientAuthConfig of a server
+type clientAuth struct {
+	mode     tls.ClientAuthType
+	pool     *x509.CertPool
+	crls     []*x509.RevocationList
+	subjects []*regexp.Regexp
+	sans     []*regexp.Regexp
+
+	mu   sync.Mutex
+	base *tls.Config
+	tls  *tls.Config
+}
+
+func newClientAuth(cfg ClientAuthConfig) (*clientAuth, error) {
+	ca := &clientAuth{}
+
+	switch cfg.Mode {
+	case ClientAuthNone:
+		ca.mode = tls.NoClientCert
+	case ClientAuthRequest:
+		ca.mode = tls.RequestClientCert
+	case ClientAuthRequire:
+		ca.mode = tls.RequireAnyClientCert
+	case "", ClientAuthVerify:
+		ca.mode = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("client_auth: unknown mode %q", cfg.Mode)
+	}
+
+	verify := ca.mode == tls.RequireAndVerifyClientCert
+	if verify && len(cfg.CAFiles) == 0 {
+		return nil, fmt.Errorf("client_auth: verify needs ca_files")
+	}
+	if !verify && (len(cfg.CRLFiles) > 0 || len(cfg.AllowedSubjects) > 0 || len(cfg.AllowedSANs) > 0) {
+		return nil, fmt.Errorf("client_auth: crl_files and allow-lists need mode verify")
+	}
+
+	if len(cfg.CAFiles) > 0 {
+		pool, err := loadCertPool(cfg.CAFiles...)
+		if err != nil {
+			return nil, fmt.Errorf("client_auth: %v", err)
+		}
+		ca.pool = pool
+	}
+
+	for _, path := range cfg.CRLFiles {
+		crl, err := loadCRL(path)
+		if err != nil {
+			return nil, fmt.Errorf("client_auth: %v", err)
+		}
+		ca.crls = append(ca.crls, crl)
+	}
+
+	var err error
+	if ca.subjects, err = compilePatterns(cfg.AllowedSubjects); err != nil {
+		return nil, fmt.Errorf("client_auth: %v", err)
+	}
+	if ca.sans, err = compilePatterns(cfg.AllowedSANs); err != nil {
+		return nil, fmt.Errorf("client_auth: %v", err)
+	}
+
+	if _, err := compileHeaderRules(*cfg.headerRules()); err != nil {
+		return nil, fmt.Errorf("client_auth: %v", err)
+	}
+
+	return ca, nil
+}
+
+// headerRules sets the client certificate headers sent upstream. Clients
+// can't forge them, they are replaced on every request.
+func (cfg ClientAuthConfig) headerRules() *HeaderRules {
+	headers := cfg.Headers
+	if headers == nil {
+		headers = defaultClientCertHeaders
+	}
+	return &HeaderRules{Set: headers}
+}
+
+// authorizeClient enforces the client auth of the server a request was
+// routed to. A client could pass the handshake of one server and name
+// another in the Host header, such requests get a 421.
+func authorizeClient(w http.ResponseWriter, r *http.Request, hr *hostRouter, routes []THostServer) bool {
+	if len(routes) == 0 || routes[0].clientAuth == nil {
+		return true
+	}
+	ca := routes[0].clientAuth
+	if ca.mode != tls.RequireAnyClientCert && ca.mode != tls.RequireAndVerifyClientCert {
+		return true
+	}
+
+	if r.TLS != nil {
+		// servers share their routes slice under every name
+		sni, ok := hr.lookup(r.TLS.ServerName)
+		if !ok || len(sni) == 0 || &sni[0] != &routes[0] {
+			http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+			return false
+		}
+	}
+	if !ca.authorize(r) {
+		http.Error(w, "Client certificate required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// loadCRL reads a PEM or DER certificate revocation list
+func loadCRL(path string) (*x509.RevocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRL %s: %v", path, err)
+	}
+	return crl, nil
+}
+
+// compilePatterns compiles allow-list patterns, "~regex" or a name where *
+// matches anything
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		if isRegexHost(pattern) {
+			expr = pattern[1:]
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// tlsConfig returns base asking for client certificates the way the server
+// wants them
+func (ca *clientAuth) tlsConfig(base *tls.Config) *tls.Config {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if ca.base != base {
+		config := base.Clone()
+		config.ClientAuth = ca.mode
+		config.ClientCAs = ca.pool
+		if ca.mode == tls.RequireAndVerifyClientCert {
+			config.VerifyConnection = ca.verifyConnection
+		}
+		ca.base, ca.tls = base, config
+	}
+	return ca.tls
+}
+
+// verifyConnection runs after the chain was verified, on resumed sessions
+// too
+func (ca *clientAuth) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 {
+		return errClientCertDenied
+	}
+	chain := cs.VerifiedChains[0]
+	if err := ca.checkRevoked(chain); err != nil {
+		return err
+	}
+	if !ca.allowed(chain[0]) {
+		return errClientCertDenied
+	}
+	return nil
+}
+
+// checkRevoked checks every certificate of the chain against the CRLs
+// signed by its issuer
+func (ca *clientAuth) checkRevoked(chain []*x509.Certificate) error {
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		for _, crl := range ca.crls {
+			if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) || crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+			for _, revoked := range crl.RevokedCertificateEntries {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("client certificate %s is revoked", cert.Subject)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// allowed reports whether the certificate passes the allow-lists. With both
+// lists set either may match.
+func (ca *clientAuth) allowed(cert *x509.Certificate) bool {
+	if len(ca.subjects) == 0 && len(ca.sans) == 0 {
+		return true
+	}
+	subject := cert.Subject.String()
+	for _, re := range ca.subjects {
+		if re.MatchString(subject) {
+			return true
+		}
+	}
+	for _, san := range certSANs(cert) {
+		for _, re := range ca.sans {
+			if re.MatchString(san) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorize checks the request against the server's client auth. The TLS
+// handshake already did, but it may have been for another server when the
+// Host header and the SNI name differ.
+func (ca *clientAuth) authorize(r *http.Request) bool {
+	switch ca.mode {
+	case tls.RequireAnyClientCert:
+		return r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+	case tls.RequireAndVerifyClientCert:
+		return r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && ca.allowed(r.TLS.VerifiedChains[0][0])
+	}
+	return true
+}
+
+// certSANs lists the DNS names, emails, IPs and URIs of a certificate
+func certSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// verifiedClientCert returns the client certificate of r, nil unless it was
+// verified
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// clientCertVariable looks up the client_cert_* header variables
+func clientCertVariable(name string, r *http.Request) string {
+	cert := verifiedClientCert(r)
+	if cert == nil {
+		return ""
+	}
+	switch name {
+	case "client_cert_subject":
+		return cert.Subject.String()
+	case "client_cert_issuer":
+		return cert.Issuer.String()
+	case "client_cert_san":
+		return strings.Join(certSANs(cert), ",")
+	case "client_cert_serial":
+		return cert.SerialNumber.Text(16)
+	case "client_cert_fingerprint":
+		sum := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(sum[:])
+	case "client_cert":
+		escaped := url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+		return strings.ReplaceAll(escaped, "+", "%20")
+	}
+	return ""
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	path string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	path := filepath.Join(dir, "ca.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	return &testCA{cert: cert, key: key, path: path}
+}
+
+// issue signs a client certificate
+func (ca *testCA) issue(t *testing.T, serial int64, subject pkix.Name, emails ...string) tls.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        subject,
+		EmailAddresses: emails,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeCRL writes a CRL revoking serials
+func (ca *testCA) writeCRL(t *testing.T, dir string, serials ...int64) string {
+	t.Helper()
+	var revoked []x509.RevocationListEntry
+	for _, serial := range serials {
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: revoked,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "ca.crl")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600)
+	return path
+}
+
+func TestClientAuth_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certPath, keyPath := writeTestCert(t, dir, "server", "mtls.example.com", "open.example.com")
+
+	var mu sync.Mutex
+	var seen http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = r.Header.Clone()
+		mu.Unlock()
+	}))
+	defer upstream.Close()
+
+	route := []RouteConfig{{Match: RouteMatch{Path: "/"}, Proxy: ProxyConfig{Upstream: []string{upstream.URL}}}}
+	cl := &ConfigLoader{Config: &Config{Servers: []ServerConfig{
+		{
+			Listen: ":443", Ssl: true, Host: "mtls.example.com", Default: true,
+			CertFile: certPath, KeyFile: keyPath, Routes: route,
+			ClientAuth: &ClientAuthConfig{
+				CAFiles:         []string{ca.path},
+				CRLFiles:        []string{ca.writeCRL(t, dir, 13)},
+				AllowedSubjects: []string{"CN=*,O=Acme"},
+				AllowedSANs:     []string{"*@partner.example.com"},
+			},
+		},
+		{Listen: ":443", Ssl: true, Host: "open.example.com", CertFile: certPath, KeyFile: keyPath, Routes: route},
+	}}}
+	assert.NoError(t, cl.Config.Validate())
+	proxyServers, err := cl.CreateProxyServers()
+	assert.NoError(t, err)
+	defer cl.Stop()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &http.Server{Handler: proxyServers[":443"].HttpHandler, TLSConfig: cl.TLSConfig(":443", nil)}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	get := func(serverName, host string, cert *tls.Certificate) (*http.Response, error) {
+		config := &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		req, _ := http.NewRequest("GET", "https://"+ln.Addr().String()+"/", nil)
+		req.Host = host
+		req.Header.Set("X-Client-Cert-Subject", "CN=forged")
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	alice := ca.issue(t, 11, pkix.Name{CommonName: "alice", Organization: []string{"Acme"}})
+	resp, err := get("mtls.example.com", "mtls.example.com", &alice)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		mu.Lock()
+		assert.Equal(t, "CN=alice,O=Acme", seen.Get("X-Client-Cert-Subject"), "Expected the verified subject, not the forged one")
+		escaped := seen.Get("X-Client-Cert")
+		mu.Unlock()
+		decoded, err := url.QueryUnescape(escaped)
+		assert.NoError(t, err)
+		block, _ := pem.Decode([]byte(decoded))
+		if assert.NotNil(t, block) {
+			assert.Equal(t, alice.Certificate[0], block.Bytes)
+		}
+	}
+
+	partner := ca.issue(t, 12, pkix.Name{CommonName: "bob", Organization: []string{"Partner"}}, "bob@partner.example.com")
+	resp, err = get("mtls.example.com", "mtls.example.com", &partner)
+	if assert.NoError(t, err, "Expected the SAN allow-list to admit the client") {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	_, err = get("mtls.example.com", "mtls.example.com", nil)
+	assert.Error(t, err, "Expected clients without a certificate rejected")
+
+	other := ca.issue(t, 14, pkix.Name{CommonName: "eve", Organization: []string{"Other"}})
+	_, err = get("mtls.example.com", "mtls.example.com", &other)
+	assert.Error(t, err, "Expected clients outside the allow-lists rejected")
+
+	revoked := ca.issue(t, 13, pkix.Name{CommonName: "mallory", Organization: []string{"Acme"}})
+	_, err = get("mtls.example.com", "mtls.example.com", &revoked)
+	assert.Error(t, err, "Expected revoked certificates rejected")
+
+	resp, err = get("open.example.com", "open.example.com", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err = get("open.example.com", "mtls.example.com", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode, "Expected the handshake of another server not to count")
+	}
+}
+
+func TestClientAuthConfig_Validate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+
+	_, err := newClientAuth(ClientAuthConfig{Mode: ClientAuthRequest})
+	assert.NoError(t, err)
+	_, err = newClientAuth(ClientAuthConfig{CAFiles: []string{ca.path}, AllowedSubjects: []string{"~^CN=svc-[a-z]+$"}})
+	assert.NoError(t, err)
+
+	tests := []ClientAuthConfig{
+		{Mode: "optional"},
+		{Mode: ClientAuthVerify},
+		{Mode: ClientAuthRequire, CRLFiles: []string{ca.writeCRL(t, dir)}},
+		{Mode: ClientAuthRequest, AllowedSANs: []string{"*.example.com"}},
+		{CAFiles: []string{filepath.Join(dir, "missing.pem")}},
+		{CAFiles: []string{ca.path}, CRLFiles: []string{ca.path}},
+		{CAFiles: []string{ca.path}, AllowedSubjects: []string{"~("}},
+		{CAFiles: []string{ca.path}, Headers: map[string]string{"X-Cert": "${nope}"}},
+	}
+	for i, cfg := range tests {
+		_, err := newClientAuth(cfg)
+		assert.Error(t, err, "case %d", i)
+	}
+
+	route := []RouteConfig{{Match: RouteMatch{Path: "/"}, Proxy: ProxyConfig{Upstream: []string{"http://localhost:8081"}}}}
+	cfg := &Config{Servers: []ServerConfig{{Listen: ":80", Host: "example.com", Routes: route, ClientAuth: &ClientAuthConfig{CAFiles: []string{ca.path}}}}}
+	assert.Error(t, cfg.Validate(), "Expected client_auth to need ssl")
+}
+
+func TestCompilePatterns(t *testing.T) {
+	patterns, err := compilePatterns([]string{"CN=*,O=Acme", "~^spiffe://example\\.org/"})
+	assert.NoError(t, err)
+	assert.True(t, patterns[0].MatchString("CN=alice,O=Acme"))
+	assert.False(t, patterns[0].MatchString("CN=alice,O=Acme Evil"))
+	assert.True(t, patterns[1].MatchString("spiffe://example.org/ns/default"))
+}
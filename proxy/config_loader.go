@@ -1,22 +1,76 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"net/http"
-	"strings"
+	"net/url"
+	"path"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/acme"
 )
 
 type ConfigLoader struct {
 	Config *Config
+
+	filename string
+	mu       sync.Mutex
+	servers  map[string]*TProxyServer
+	proxies  map[string]*ProxyServer
+	metrics  *metrics
+	// shared by every listener and configured again on reload
+	accessLog *accessLogger
+	certs     *certStore
 }
 
 type TProxyServer struct {
 	Ssl         bool
+	Timeouts    ListenerTimeouts
 	HttpHandler http.Handler
+
+	handler *swapHandler
+}
+
+// swapHandler lets the handler of a running listener be replaced in place
+type swapHandler struct {
+	current atomic.Value
+}
+
+func newSwapHandler(h http.Handler) *swapHandler {
+	sh := &swapHandler{}
+	sh.Store(h)
+	return sh
+}
+
+func (sh *swapHandler) Store(h http.Handler) {
+	sh.current.Store(&h)
+}
+
+func (sh *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*sh.current.Load().(*http.Handler)).ServeHTTP(w, r)
+}
+
+func newTProxyServer(ssl bool, timeouts ListenerTimeouts, h http.Handler) *TProxyServer {
+	sh := newSwapHandler(h)
+	return &TProxyServer{
+		Ssl:         ssl,
+		Timeouts:    timeouts,
+		HttpHandler: sh,
+		handler:     sh,
+	}
 }
 
 type THostServer struct {
-	path string
-	px   *ProxyServer
+	match   *routeMatcher
+	rewrite *pathRewriter
+	limits  []*rateLimiter // server then route rate limits
+	// nil when the server does not ask for client certificates
+	clientAuth *clientAuth
+	metrics    *routeMetrics
+	px         *ProxyServer
 }
 
 func NewConfigLoader(filename string) (*ConfigLoader, error) {
@@ -25,86 +79,529 @@ func NewConfigLoader(filename string) (*ConfigLoader, error) {
 		return nil, err
 	}
 
-	return &ConfigLoader{Config: cfg}, nil
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &ConfigLoader{
+		Config:    cfg,
+		filename:  filename,
+		metrics:   newMetrics(),
+		accessLog: newAccessLogger(),
+		certs:     newCertStore(),
+	}, nil
+}
+
+// GetConfig returns the config currently being served
+func (cl *ConfigLoader) GetConfig() *Config {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.Config
 }
 
 func (cl *ConfigLoader) CreateProxyServers() (map[string]*TProxyServer, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.metrics == nil {
+		cl.metrics = newMetrics()
+	}
+	if cl.accessLog == nil {
+		cl.accessLog = newAccessLogger()
+	}
+	if err := cl.accessLog.configure(cl.Config.AccessLog); err != nil {
+		return nil, err
+	}
+	if cl.certs == nil {
+		cl.certs = newCertStore()
+	}
+	if err := cl.certs.update(cl.Config); err != nil {
+		return nil, err
+	}
+
+	handlers, proxies, err := buildHandlers(cl.Config, nil, cl.metrics, cl.accessLog)
+	if err != nil {
+		return nil, err
+	}
+
+	cl.proxies = proxies
+	cl.servers = make(map[string]*TProxyServer)
 	proxyServers := make(map[string]*TProxyServer)
-	hostServers := make(map[string][]THostServer)
+	for listen, h := range handlers {
+		cl.servers[listen] = newTProxyServer(listenSsl(cl.Config, listen), listenTimeouts(cl.Config, listen), h)
+		proxyServers[listen] = cl.servers[listen]
+	}
+	commitUpstreams(proxies)
+	startProxies(proxies)
 
-	for _, server := range cl.Config.Servers {
-		if _, ok := hostServers[server.Host]; !ok {
-			hostServers[server.Host] = []THostServer{}
+	return proxyServers, nil
+}
+
+// TLSConfig returns the tls.Config of a TLS listener. Static certificates
+// and client auth are picked by SNI name and follow reloads, names without
+// a static certificate are handed to fallback.
+func (cl *ConfigLoader) TLSConfig(listen string, fallback GetCertificateFunc) *tls.Config {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.certs == nil {
+		cl.certs = newCertStore()
+	}
+
+	config := &tls.Config{
+		GetCertificate: cl.certs.getCertificate(listen, fallback),
+		// TLS-ALPN-01 challenges work without the :80 listener
+		NextProtos: []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+	config.GetConfigForClient = cl.certs.getConfigForClient(listen, config)
+	return config
+}
+
+// AdminHandler serves the proxy's own endpoints on the admin listener
+func (cl *ConfigLoader) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+
+		if cl.Config.Admin == nil || r.URL.Path != cl.Config.Admin.metricsPath() || cl.metrics == nil {
+			http.NotFound(w, r)
+			return
 		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		cl.metrics.writeMetrics(w, cl.Config, cl.proxies)
+	})
+}
+
+// Stop stops the health checks of every proxy server
+func (cl *ConfigLoader) Stop() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	stopProxies(cl.proxies)
+}
+
+// Reload re-reads the config file and swaps the handlers of the running
+// listeners in place. Listeners that are new, or whose ssl or timeouts changed,
+// are returned in added and must be started by the caller, one that fails to
+// start is given back with DropListener. Listeners that are gone (or
+// changed) are returned in removed and should be drained.
+// If the new config fails to load the current one keeps serving.
+func (cl *ConfigLoader) Reload() (added, removed map[string]*TProxyServer, err error) {
+	cfg, err := LoadConfig(cl.filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	// everything is built before any of it is swapped in, so a config that
+	// fails here leaves the current one serving untouched
+	handlers, proxies, err := buildHandlers(cfg, cl.proxies, cl.metrics, cl.accessLog)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certs, err := cl.certs.prepare(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accessLog, err := cl.accessLog.prepare(cfg.AccessLog)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cl.certs.swap(certs)
+	cl.accessLog.apply(accessLog)
+
+	added = make(map[string]*TProxyServer)
+	removed = make(map[string]*TProxyServer)
+	servers := make(map[string]*TProxyServer)
+
+	for listen, h := range handlers {
+		ssl := listenSsl(cfg, listen)
+		timeouts := listenTimeouts(cfg, listen)
+		if server, ok := cl.servers[listen]; ok && server.Ssl == ssl && server.Timeouts == timeouts {
+			server.handler.Store(h)
+			servers[listen] = server
+			continue
+		}
+
+		servers[listen] = newTProxyServer(ssl, timeouts, h)
+		added[listen] = servers[listen]
+	}
+
+	for listen, server := range cl.servers {
+		if servers[listen] != server {
+			removed[listen] = server
+		}
+	}
+
+	// reused upstream servers take the weights of the new config once its
+	// handlers serve. The old proxy servers keep finishing their requests,
+	// only their health checks stop. They stop before the new ones start so
+	// a reused upstream server is never checked twice.
+	commitUpstreams(proxies)
+	stopProxies(cl.proxies)
+	startProxies(proxies)
+	cl.metrics.retain(cfg)
+
+	cl.Config = cfg
+	cl.servers = servers
+	cl.proxies = proxies
+
+	return added, removed, nil
+}
+
+// DropListener forgets a listener returned in added that failed to start,
+// so the next reload adds it again
+func (cl *ConfigLoader) DropListener(listen string, server *TProxyServer) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.servers[listen] == server {
+		delete(cl.servers, listen)
+	}
+}
+
+// buildHandlers creates the proxy servers for every route of cfg and the
+// handler for every listener. The proxy servers are not started yet.
+// Upstream servers of previous proxies are reused when the route and
+// upstream URL are unchanged, rate limiters when the route and their
+// config are. Request metrics of every route are recorded in m, every
+// request is logged to accessLog.
+func buildHandlers(cfg *Config, previous map[string]*ProxyServer, m *metrics, accessLog *accessLogger) (map[string]http.Handler, map[string]*ProxyServer, error) {
+	proxies := make(map[string]*ProxyServer)
+	// routing tables are scoped to each listen address, several servers
+	// sharing one listen address share its table
+	hostRouters := make(map[string]*hostRouter)
+
+	for _, server := range cfg.Servers {
+		if _, ok := hostRouters[server.Listen]; !ok {
+			hostRouters[server.Listen] = newHostRouter()
+		}
+		hostServers := []THostServer{}
+
+		// one limiter shared by all routes of the server, taken over from
+		// the previous proxies of the server when its config is unchanged
+		var serverLimit *rateLimiter
+		if server.RateLimit != nil {
+			var existing *rateLimiter
+			for _, route := range server.Routes {
+				if px, ok := previous[routeKey(server, route)]; ok && px.serverLimit != nil {
+					existing = px.serverLimit
+					break
+				}
+			}
+			limiter, err := reuseRateLimiter(existing, *server.RateLimit)
+			if err != nil {
+				return nil, nil, err
+			}
+			serverLimit = limiter
+		}
+
+		var ca *clientAuth
+		requestHeaders := []*HeaderRules{server.RequestHeaders}
+		if server.ClientAuth != nil {
+			var err error
+			if ca, err = newClientAuth(*server.ClientAuth); err != nil {
+				return nil, nil, err
+			}
+			requestHeaders = append([]*HeaderRules{server.ClientAuth.headerRules()}, requestHeaders...)
+		}
+		responseHeaders := []*HeaderRules{server.ResponseHeaders}
+		if server.HSTS != nil {
+			responseHeaders = append([]*HeaderRules{server.HSTS.headerRules()}, responseHeaders...)
+		}
+
+		labels := routeLabels(server)
 
 		// Create a router to handle different routes
-		for _, route := range server.Routes {
-			px, err := createProxyServer(route)
+		for i, route := range server.Routes {
+			key := routeKey(server, route)
+
+			match, err := compileRouteMatch(route.Match)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			rewrite, err := compileRewrite(route.Rewrite, match)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			var limits []*rateLimiter
+			if serverLimit != nil {
+				limits = append(limits, serverLimit)
+			}
+
+			var existing map[string]*UpstreamServer
+			var existingLimit *rateLimiter
+			if px, ok := previous[key]; ok {
+				existing = px.upstreams()
+				existingLimit = px.routeLimit
+			}
+
+			var routeLimit *rateLimiter
+			if route.Proxy.RateLimit != nil {
+				routeLimit, err = reuseRateLimiter(existingLimit, *route.Proxy.RateLimit)
+				if err != nil {
+					return nil, nil, err
+				}
+				limits = append(limits, routeLimit)
+			}
+
+			px, err := createProxyServer(route, existing)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = px.SetHeaders(
+				append(requestHeaders, route.RequestHeaders),
+				append(responseHeaders, route.ResponseHeaders),
+			)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
+			px.serverLimit = serverLimit
+			px.routeLimit = routeLimit
+			proxies[key] = px
 
 			// Append the new THostServer to the list
-			hostServers[server.Host] = append(hostServers[server.Host], THostServer{
-				path: route.Match.Path,
-				px:   px,
+			hostServers = append(hostServers, THostServer{
+				match:      match,
+				rewrite:    rewrite,
+				limits:     limits,
+				clientAuth: ca,
+				metrics:    m.route(server.Listen, server.HostNames()[0], labels[i]),
+				px:         px,
 			})
 		}
+
+		sortHostServers(hostServers)
+		if err := hostRouters[server.Listen].add(server.HostNames(), server.Default, hostServers); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	for _, server := range cl.Config.Servers {
-		mux := createMuxServer(&hostServers)
-		proxyServers[server.Listen] = &TProxyServer{
-			Ssl:         server.Ssl,
-			HttpHandler: mux,
+	fw, err := newForwarding(cfg.Forwarding)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	handlers := make(map[string]http.Handler)
+	for listen, hr := range hostRouters {
+		handlers[listen] = createMuxServer(listen, hr, fw, accessLog)
+	}
+
+	return handlers, proxies, nil
+}
+
+func commitUpstreams(proxies map[string]*ProxyServer) {
+	for _, px := range proxies {
+		px.commitUpstreams()
+	}
+}
+
+func startProxies(proxies map[string]*ProxyServer) {
+	for _, px := range proxies {
+		px.Start(context.Background())
+	}
+}
+
+func stopProxies(proxies map[string]*ProxyServer) {
+	for _, px := range proxies {
+		px.Stop()
+	}
+}
+
+// routeKey identifies a route across reloads
+func routeKey(server ServerConfig, route RouteConfig) string {
+	return fmt.Sprintf("%s|%v|%+v", server.Listen, server.HostNames(), route.Match)
+}
+
+// listenSsl reports whether the listener should serve TLS. Validate makes
+// sure all servers sharing a listen address agree on it.
+func listenSsl(cfg *Config, listen string) bool {
+	for _, server := range cfg.Servers {
+		if server.Listen == listen {
+			return server.Ssl
 		}
 	}
+	return false
+}
 
-	return proxyServers, nil
+// listenTimeouts returns the timeouts of the listener. Validate makes sure
+// the servers sharing a listen address that set them agree.
+func listenTimeouts(cfg *Config, listen string) ListenerTimeouts {
+	for _, server := range cfg.Servers {
+		if server.Listen == listen && server.Timeouts != nil {
+			return *server.Timeouts
+		}
+	}
+	return ListenerTimeouts{}
 }
 
-func createMuxServer(hostServers *map[string][]THostServer) http.Handler {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		host := r.Host
+// createMuxServer routes requests by host, falling back to the default
+// server of the listener, and then to the first matching route. Routes are
+// sorted most specific first. Paths that are not clean are redirected to
+// their clean form, like http.ServeMux does, so every matcher sees the
+// canonical path. The forwarding headers are set first, rate limits are
+// checked, then the route's rewrite is applied before the request is
+// proxied. Every request is recorded in the route's metrics and the access
+// log.
+func createMuxServer(listen string, hr *hostRouter, fw *forwarding, accessLog *accessLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := newRequestInfo(listen, r)
+		info.clientIP = fw.apply(r, listen)
+		if accessLog.enabled() {
+			info.ensureRequestID(r)
+		}
+
+		rec := newResponseRecorder(w)
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &countingBody{ReadCloser: r.Body, info: info}
+		}
+		defer func() {
+			if info.metrics != nil {
+				info.metrics.observe(info, rec.Status(), rec.bytes)
+			}
+			accessLog.log(r, info, rec.Status(), rec.bytes)
+		}()
 
-		if hostServer, ok := (*hostServers)[host]; ok {
+		// ".." must not climb out of a route
+		if r.Method != http.MethodConnect {
+			if p := cleanPath(r.URL.Path); p != r.URL.Path {
+				u := &url.URL{Path: p, RawQuery: r.URL.RawQuery}
+				http.Redirect(rec, r, u.String(), http.StatusMovedPermanently)
+				return
+			}
+		}
+
+		if hostServer, ok := hr.lookup(r.Host); ok {
+			if !authorizeClient(rec, r, hr, hostServer) {
+				return
+			}
 			for _, hs := range hostServer {
-				if strings.HasPrefix(r.URL.Path, hs.path) {
-					r.URL.Path = r.URL.Path[len(hs.path):]
-					hs.px.ServeHTTP(w, r)
+				if hs.match.matches(r) {
+					serveRoute(rec, r, hs)
 					return
 				}
 			}
 		}
-		http.NotFound(w, r)
+		http.NotFound(rec, r)
 	})
+}
+
+// cleanPath returns the canonical path of p, keeping a trailing slash, the
+// way http.ServeMux cleans it
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	np := path.Clean(p)
+	if p[len(p)-1] == '/' && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+// serveRoute proxies a request matched by hs
+func serveRoute(w http.ResponseWriter, r *http.Request, hs THostServer) {
+	info := requestInfoFrom(r.Context())
+	info.host = hs.metrics.host
+	info.route = hs.metrics.route
+	info.metrics = hs.metrics
 
-	return mux
+	for _, limiter := range hs.limits {
+		if !limiter.allow(w, r) {
+			return
+		}
+	}
+	hs.rewrite.rewrite(r, hs.match)
+	hs.px.ServeHTTP(w, r)
 }
 
-func createProxyServer(route RouteConfig) (*ProxyServer, error) {
+func createProxyServer(route RouteConfig, existing map[string]*UpstreamServer) (*ProxyServer, error) {
 	// 創建代理服務器
-	px, err := NewProxyServer(route.Proxy.Upstream)
+	px, err := newProxyServer(route.Proxy.Upstream, existing)
 	if err != nil {
 		return nil, err
 	}
 
+	// weights not set below are 0
+	px.weights = make(map[string]int32)
+
 	// set strategy
 	if route.Proxy.Strategy.Type != "" {
 		px.LoadBalancer.UpdateStrategy(route.Proxy.Strategy.Type)
 
-		// set weight for weightRR
-		if route.Proxy.Strategy.Type == WeightedRR {
+		// set weight for weightRR and consistent hash
+		if route.Proxy.Strategy.Type == WeightedRR || route.Proxy.Strategy.Type == ConsistentHash {
 			if weights, ok := route.Proxy.Strategy.Config["weights"].(map[string]interface{}); ok {
 				for url, weight := range weights {
 					if w, ok := weight.(int); ok {
-						px.LoadBalancer.SetServerWeight(url, int32(w))
+						px.setWeight(url, int32(w))
 					}
 				}
 			}
 
 		}
+
+		// set hash key for consistent hash, the client IP by default
+		if route.Proxy.Strategy.Type == ConsistentHash {
+			source, name := route.Proxy.Strategy.hashKey()
+			px.LoadBalancer.SetHashKey(source, name)
+		}
+	}
+
+	if route.Proxy.Strategy.Sticky != nil {
+		px.LoadBalancer.SetStickySession(*route.Proxy.Strategy.Sticky)
+	}
+
+	if route.Proxy.MaxConns > 0 {
+		px.setMaxConns(route.Proxy.MaxConns, route.Proxy.Queue)
+	}
+
+	if route.Proxy.CircuitBreaker != nil {
+		px.SetCircuitBreaker(*route.Proxy.CircuitBreaker)
+	}
+
+	if route.Proxy.OutlierDetection != nil {
+		px.SetOutlierDetection(*route.Proxy.OutlierDetection)
+	}
+
+	if route.Proxy.Timeouts != nil {
+		px.SetTimeouts(*route.Proxy.Timeouts)
+	}
+
+	if route.Proxy.UpstreamTLS != nil {
+		if err := px.SetUpstreamTLS(*route.Proxy.UpstreamTLS); err != nil {
+			return nil, err
+		}
+	}
+
+	if route.Proxy.Buffer != nil {
+		if err := px.SetBuffer(*route.Proxy.Buffer); err != nil {
+			return nil, err
+		}
+	}
+
+	if route.Proxy.Retry != nil {
+		if err := px.SetRetry(*route.Proxy.Retry); err != nil {
+			return nil, err
+		}
+	}
+
+	if route.Proxy.HealthCheck != nil {
+		if err := px.SetHealthCheck(*route.Proxy.HealthCheck); err != nil {
+			return nil, err
+		}
 	}
 
 	return px, nil
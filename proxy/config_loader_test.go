@@ -1,8 +1,13 @@
 package proxy
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -46,6 +51,7 @@ func TestCreateProxyServers(t *testing.T) {
 	// Test CreateProxyServers
 	proxyServers, err := cl.CreateProxyServers()
 	assert.NoError(t, err, "CreateProxyServers should not return an error")
+	defer cl.Stop()
 
 	// Validate that the proxy server is created
 	server, exist := proxyServers[":8080"]
@@ -63,3 +69,395 @@ func TestCreateProxyServers(t *testing.T) {
 	// Check response
 	assert.Equal(t, http.StatusMovedPermanently, rec.Code, "Expected status code 301. proxy will redirect the request")
 }
+
+func TestCreateMuxServer_CleanPath(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Upstream-Path", r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	cl := &ConfigLoader{Config: &Config{Servers: []ServerConfig{{
+		Listen: ":8080",
+		Host:   "example.com",
+		Routes: []RouteConfig{{
+			Match: RouteMatch{Path: "/public"},
+			Proxy: ProxyConfig{Upstream: []string{upstream.URL}},
+		}},
+	}}}}
+	proxyServers, err := cl.CreateProxyServers()
+	assert.NoError(t, err)
+	defer cl.Stop()
+
+	tests := []struct {
+		target   string
+		code     int
+		location string
+	}{
+		{"/public/../admin", http.StatusMovedPermanently, "/admin"},
+		{"/public/./a//b?q=1", http.StatusMovedPermanently, "/public/a/b?q=1"},
+		{"/public/a/", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.URL.Path, req.URL.RawQuery, _ = strings.Cut(tt.target, "?")
+		rec := httptest.NewRecorder()
+		proxyServers[":8080"].HttpHandler.ServeHTTP(rec, req)
+
+		assert.Equal(t, tt.code, rec.Code, tt.target)
+		assert.Equal(t, tt.location, rec.Header().Get("Location"), tt.target)
+		if tt.code == http.StatusOK {
+			assert.Equal(t, "/a/", rec.Header().Get("Upstream-Path"), "Expected the trailing slash kept")
+		}
+	}
+}
+
+func writeConfigFile(t *testing.T, filename string, content string) {
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("Fail to write config file %v", err)
+	}
+}
+
+func TestConfigLoader_Reload(t *testing.T) {
+	initialConfig := `
+servers:
+  - listen: ":8080"
+    ssl: false
+    host: "example.com"
+    routes:
+      - match:
+          path: "/"
+        proxy:
+          upstream:
+            - "http://localhost:8081"
+            - "http://localhost:8082"
+`
+	reloadedConfig := `
+servers:
+  - listen: ":8080"
+    ssl: false
+    host: "example.com"
+    routes:
+      - match:
+          path: "/"
+        proxy:
+          upstream:
+            - "http://localhost:8081"
+            - "http://localhost:8083"
+  - listen: ":9090"
+    ssl: false
+    host: "test.com"
+    routes:
+      - match:
+          path: "/"
+        proxy:
+          upstream:
+            - "http://localhost:8084"
+`
+
+	filename := filepath.Join(t.TempDir(), "setting.yaml")
+	writeConfigFile(t, filename, initialConfig)
+
+	cl, err := NewConfigLoader(filename)
+	assert.NoError(t, err, "NewConfigLoader should not return an error")
+
+	proxyServers, err := cl.CreateProxyServers()
+	assert.NoError(t, err, "CreateProxyServers should not return an error")
+	defer cl.Stop()
+
+	// keep some state on the upstream that stays in the config
+	oldProxy := cl.proxies[routeKey(cl.Config.Servers[0], cl.Config.Servers[0].Routes[0])]
+	kept := oldProxy.upstreams()["http://localhost:8081"]
+	kept.ActiveConns = 2
+	kept.SetAlive(false)
+
+	writeConfigFile(t, filename, reloadedConfig)
+	added, removed, err := cl.Reload()
+	assert.NoError(t, err, "Reload should not return an error")
+	assert.Len(t, added, 1, "Expected the :9090 listener to be added")
+	assert.Contains(t, added, ":9090")
+	assert.Empty(t, removed, "Expected no listener to be removed")
+
+	// the running listener keeps its handler and the unchanged upstream keeps its state
+	assert.Same(t, proxyServers[":8080"], cl.servers[":8080"], "Expected :8080 to be swapped in place")
+	newProxy := cl.proxies[routeKey(cl.Config.Servers[0], cl.Config.Servers[0].Routes[0])]
+	upstreams := newProxy.upstreams()
+	assert.Same(t, kept, upstreams["http://localhost:8081"], "Expected upstream state to be reused")
+	assert.Equal(t, int32(2), upstreams["http://localhost:8081"].ActiveConns)
+	assert.Contains(t, upstreams, "http://localhost:8083")
+	assert.NotContains(t, upstreams, "http://localhost:8082")
+
+	// a listener that failed to start is added again on the next reload
+	cl.DropListener(":9090", added[":9090"])
+	added, _, err = cl.Reload()
+	assert.NoError(t, err, "Reload should not return an error")
+	assert.Contains(t, added, ":9090", "Expected the failed listener retried")
+
+	// a broken config leaves the old one serving
+	writeConfigFile(t, filename, "servers: [")
+	_, _, err = cl.Reload()
+	assert.Error(t, err, "Reload should fail on an invalid config")
+	assert.Len(t, cl.GetConfig().Servers, 2, "Expected old config to keep serving")
+
+	// removing a listener reports it for draining
+	writeConfigFile(t, filename, initialConfig)
+	added, removed, err = cl.Reload()
+	assert.NoError(t, err, "Reload should not return an error")
+	assert.Empty(t, added)
+	assert.Contains(t, removed, ":9090")
+}
+
+func TestConfigLoader_ReloadKeepsRateLimits(t *testing.T) {
+	config := func(routeRequests int) string {
+		return fmt.Sprintf(`
+servers:
+  - listen: ":8080"
+    host: "example.com"
+    rate_limit:
+      requests: 5
+      period: "1h"
+    routes:
+      - match:
+          path: "/"
+        proxy:
+          upstream:
+            - "http://localhost:8081"
+          rate_limit:
+            requests: %d
+            period: "1h"
+`, routeRequests)
+	}
+
+	filename := filepath.Join(t.TempDir(), "setting.yaml")
+	writeConfigFile(t, filename, config(1))
+
+	cl, err := NewConfigLoader(filename)
+	assert.NoError(t, err)
+	proxyServers, err := cl.CreateProxyServers()
+	assert.NoError(t, err)
+	defer cl.Stop()
+
+	send := func() int {
+		rec := httptest.NewRecorder()
+		proxyServers[":8080"].HttpHandler.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+		return rec.Code
+	}
+	key := routeKey(cl.Config.Servers[0], cl.Config.Servers[0].Routes[0])
+	old := cl.proxies[key]
+	assert.NotEqual(t, http.StatusTooManyRequests, send())
+
+	// an unchanged config keeps the buckets
+	_, _, err = cl.Reload()
+	assert.NoError(t, err)
+	assert.Same(t, old.serverLimit, cl.proxies[key].serverLimit)
+	assert.Same(t, old.routeLimit, cl.proxies[key].routeLimit)
+	assert.Equal(t, http.StatusTooManyRequests, send(), "Expected the used up route limit kept")
+
+	// a changed route limit starts over, the server limit is kept
+	writeConfigFile(t, filename, config(2))
+	_, _, err = cl.Reload()
+	assert.NoError(t, err)
+	assert.Same(t, old.serverLimit, cl.proxies[key].serverLimit)
+	assert.NotSame(t, old.routeLimit, cl.proxies[key].routeLimit)
+	assert.NotEqual(t, http.StatusTooManyRequests, send())
+}
+
+func TestConfigLoader_ReloadFailureKeepsUpstreams(t *testing.T) {
+	config := func(weight int, extra string) string {
+		return fmt.Sprintf(`
+servers:
+  - listen: ":8080"
+    host: "example.com"
+    routes:
+      - match:
+          path: "/"
+        proxy:
+          upstream:
+            - "http://localhost:8081"
+            - "http://localhost:8082"
+          max_conns: %[1]d
+          strategy:
+            type: "weighted-round-robin"
+            config:
+              weights:
+                "http://localhost:8081": %[1]d
+                "http://localhost:8082": 1
+%[2]s`, weight, extra)
+	}
+	// valid, but its access log can't be opened
+	broken := `  - listen: ":8443"
+    ssl: true
+    host: "secure.example.com"
+    routes:
+      - match:
+          path: "/"
+        proxy:
+          upstream:
+            - "http://localhost:8081"
+access_log:
+  output: "` + filepath.Join(t.TempDir(), "missing", "dir", "access.log") + `"
+`
+
+	filename := filepath.Join(t.TempDir(), "setting.yaml")
+	writeConfigFile(t, filename, config(5, ""))
+
+	cl, err := NewConfigLoader(filename)
+	assert.NoError(t, err)
+	_, err = cl.CreateProxyServers()
+	assert.NoError(t, err)
+	defer cl.Stop()
+
+	server := cl.proxies[routeKey(cl.Config.Servers[0], cl.Config.Servers[0].Routes[0])].upstreams()["http://localhost:8081"]
+	assert.Equal(t, int32(5), atomic.LoadInt32(&server.Weight))
+
+	writeConfigFile(t, filename, config(7, broken))
+	_, _, err = cl.Reload()
+	assert.Error(t, err, "Expected the access log output to fail")
+	assert.Equal(t, int32(5), atomic.LoadInt32(&server.Weight), "Expected the old weights to keep serving")
+	assert.Equal(t, int32(5), atomic.LoadInt32(&server.MaxConns), "Expected the old max_conns to keep serving")
+	assert.NotContains(t, cl.certs.listeners, ":8443", "Expected the cert store left alone")
+	assert.False(t, cl.accessLog.enabled())
+
+	writeConfigFile(t, filename, config(7, ""))
+	_, _, err = cl.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, int32(7), atomic.LoadInt32(&server.Weight), "Expected the new weights once swapped in")
+	assert.Equal(t, int32(7), atomic.LoadInt32(&server.MaxConns))
+}
+
+func TestCreateProxyServers_PerListener(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	newServer := func(listen string, host string) ServerConfig {
+		return ServerConfig{
+			Listen: listen,
+			Host:   host,
+			Routes: []RouteConfig{
+				{
+					Match: RouteMatch{Path: "/"},
+					Proxy: ProxyConfig{Upstream: []string{upstream.URL}},
+				},
+			},
+		}
+	}
+
+	cl := &ConfigLoader{Config: &Config{
+		Servers: []ServerConfig{
+			newServer(":8080", "example.com"),
+			newServer(":8080", "shared.com"),
+			newServer(":9090", "test.com"),
+		},
+	}}
+
+	proxyServers, err := cl.CreateProxyServers()
+	assert.NoError(t, err, "CreateProxyServers should not return an error")
+	defer cl.Stop()
+	assert.Len(t, proxyServers, 2, "Expected one proxy server per listen address")
+
+	tests := []struct {
+		listen string
+		host   string
+		code   int
+	}{
+		{":8080", "example.com", http.StatusOK},
+		{":8080", "shared.com", http.StatusOK},
+		{":8080", "test.com", http.StatusNotFound},
+		{":9090", "test.com", http.StatusOK},
+		{":9090", "example.com", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://"+tt.host+"/", nil)
+		rec := httptest.NewRecorder()
+		proxyServers[tt.listen].HttpHandler.ServeHTTP(rec, req)
+		assert.Equal(t, tt.code, rec.Code, "listen %s host %s", tt.listen, tt.host)
+	}
+}
+
+func TestCreateMuxServer_RouteMatch(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Server-ID", name)
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+
+	web := newUpstream("web")
+	defer web.Close()
+	api := newUpstream("api")
+	defer api.Close()
+	apiWrite := newUpstream("api-write")
+	defer apiWrite.Close()
+	beta := newUpstream("beta")
+	defer beta.Close()
+	exact := newUpstream("exact")
+	defer exact.Close()
+	regex := newUpstream("regex")
+	defer regex.Close()
+
+	route := func(match RouteMatch, upstream string) RouteConfig {
+		return RouteConfig{Match: match, Proxy: ProxyConfig{Upstream: []string{upstream}}}
+	}
+
+	cl := &ConfigLoader{Config: &Config{
+		Servers: []ServerConfig{
+			{
+				Listen: ":8080",
+				Host:   "example.com",
+				Routes: []RouteConfig{
+					// config order is not the match order
+					route(RouteMatch{Path: "/"}, web.URL),
+					route(RouteMatch{Path: "/api"}, api.URL),
+					route(RouteMatch{Path: "/api", Methods: []string{"post", "PUT"}}, apiWrite.URL),
+					route(RouteMatch{Path: "/api", Headers: []ValueMatch{{Name: "X-Beta"}}, Query: []ValueMatch{{Name: "v", Regex: "^2"}}}, beta.URL),
+					route(RouteMatch{Path: "/api/status", PathType: PathExact}, exact.URL),
+					route(RouteMatch{Path: "^/users/[0-9]+$", PathType: PathRegex}, regex.URL),
+					route(RouteMatch{Path: "/", Cookies: []ValueMatch{{Name: "canary", Value: "1"}}, Priority: 10}, beta.URL),
+				},
+			},
+		},
+	}}
+
+	proxyServers, err := cl.CreateProxyServers()
+	assert.NoError(t, err, "CreateProxyServers should not return an error")
+	defer cl.Stop()
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		header   string
+		cookie   string
+		expected string
+	}{
+		{name: "fallback prefix", method: "GET", target: "/index.html", expected: "web"},
+		{name: "longest prefix", method: "GET", target: "/api/items", expected: "api"},
+		{name: "method", method: "POST", target: "/api/items", expected: "api-write"},
+		{name: "header and query", method: "GET", target: "/api/items?v=2.1", header: "X-Beta", expected: "beta"},
+		{name: "query mismatch", method: "GET", target: "/api/items?v=1", header: "X-Beta", expected: "api"},
+		{name: "exact", method: "GET", target: "/api/status", expected: "exact"},
+		{name: "exact mismatch", method: "GET", target: "/api/status/1", expected: "api"},
+		{name: "regex", method: "GET", target: "/users/42", expected: "regex"},
+		{name: "priority", method: "GET", target: "/api/status", cookie: "1", expected: "beta"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://example.com"+tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, "on")
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "canary", Value: tt.cookie})
+			}
+			rec := httptest.NewRecorder()
+
+			proxyServers[":8080"].HttpHandler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tt.expected, rec.Header().Get("Server-ID"))
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Headers describing the client to the upstream. They are only honored when
+// the peer is a trusted proxy, otherwise the client could forge them.
+var forwardingHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+	"X-Real-IP",
+	"Forwarded",
+}
+
+// forwarding works out who the client is and writes the forwarding headers
+// sent upstream
+type forwarding struct {
+	trusted   []netip.Prefix
+	forwarded bool
+}
+
+func newForwarding(cfg *ForwardingConfig) (*forwarding, error) {
+	if cfg == nil {
+		return &forwarding{}, nil
+	}
+	trusted, err := cfg.prefixes()
+	if err != nil {
+		return nil, err
+	}
+	return &forwarding{trusted: trusted, forwarded: cfg.Forwarded}, nil
+}
+
+func (cfg ForwardingConfig) validate() error {
+	_, err := cfg.prefixes()
+	return err
+}
+
+// prefixes parses the trusted proxies, a bare IP is a single address
+func (cfg ForwardingConfig) prefixes() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range cfg.TrustedProxies {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("forwarding: invalid trusted proxy %q", s)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("forwarding: invalid trusted proxy %q", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// trusts reports whether ip is a trusted proxy
+func (fw *forwarding) trusts(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range fw.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply replaces the forwarding headers of r with what the upstream should
+// see and returns the client IP. Headers from a trusted proxy are extended,
+// from anyone else they are dropped. The reverse proxy appends the peer
+// address to X-Forwarded-For itself.
+func (fw *forwarding) apply(r *http.Request, listen string) string {
+	remote := stripPort(r.RemoteAddr)
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	client, proto, host, port := remote, scheme, r.Host, localPort(r, listen)
+
+	var chain []string
+	var previous []forwardedElement
+	if fw.trusts(remote) {
+		previous = parseForwarded(r.Header.Values("Forwarded"))
+
+		chain = splitList(r.Header.Values("X-Forwarded-For"))
+		if len(chain) == 0 {
+			for _, element := range previous {
+				chain = append(chain, element.forNode)
+			}
+		}
+		client = fw.clientFrom(chain, remote)
+
+		// the first proxy saw the original request
+		var first forwardedElement
+		if len(previous) > 0 {
+			first = previous[0]
+		}
+		if v := firstValue(r.Header.Get("X-Forwarded-Proto"), first.proto); v == "http" || v == "https" {
+			proto = v
+			port = defaultPort(proto)
+		}
+		if v := firstValue(r.Header.Get("X-Forwarded-Host"), first.host); v != "" {
+			host = v
+		}
+		if v := firstValue(r.Header.Get("X-Forwarded-Port"), ""); v != "" {
+			if _, err := strconv.ParseUint(v, 10, 16); err == nil {
+				port = v
+			}
+		}
+	}
+
+	for _, name := range forwardingHeaders {
+		r.Header.Del(name)
+	}
+	if len(chain) > 0 {
+		r.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	}
+	r.Header.Set("X-Real-IP", client)
+	r.Header.Set("X-Forwarded-Proto", proto)
+	r.Header.Set("X-Forwarded-Host", host)
+	if port != "" {
+		r.Header.Set("X-Forwarded-Port", port)
+	}
+
+	if fw.forwarded {
+		// this hop's element goes after those of the trusted proxies
+		elements := make([]string, 0, len(previous)+1)
+		for _, element := range previous {
+			elements = append(elements, element.raw)
+		}
+		elements = append(elements, fmt.Sprintf("for=%s;host=%s;proto=%s",
+			forwardedNode(remote), quoteForwarded(r.Host), scheme))
+		r.Header.Set("Forwarded", strings.Join(elements, ", "))
+	}
+
+	return client
+}
+
+// clientFrom walks the chain of addresses from the right, skipping trusted
+// proxies, and returns the first address that is not one. Everything left
+// of it could be forged by the client.
+func (fw *forwarding) clientFrom(chain []string, remote string) string {
+	addrs := make([]string, 0, len(chain)+1)
+	for _, node := range chain {
+		addrs = append(addrs, nodeIP(node))
+	}
+	addrs = append(addrs, remote)
+
+	for i := len(addrs) - 1; i > 0; i-- {
+		if !fw.trusts(addrs[i]) {
+			return addrs[i]
+		}
+		if _, err := netip.ParseAddr(addrs[i-1]); err != nil {
+			// garbage from before the trusted proxies, stop at the last good hop
+			return addrs[i]
+		}
+	}
+	return addrs[0]
+}
+
+// forwardedElement is one hop of the Forwarded header
+type forwardedElement struct {
+	raw     string
+	forNode string
+	host    string
+	proto   string
+}
+
+// parseForwarded reads the elements of the Forwarded header, RFC 7239
+func parseForwarded(values []string) []forwardedElement {
+	var elements []forwardedElement
+	for _, value := range values {
+		for _, raw := range splitQuoted(value, ',') {
+			raw = strings.TrimSpace(raw)
+			if raw == "" {
+				continue
+			}
+			element := forwardedElement{raw: raw}
+			for _, pair := range splitQuoted(raw, ';') {
+				name, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				v = unquoteForwarded(v)
+				switch strings.ToLower(name) {
+				case "for":
+					element.forNode = v
+				case "host":
+					element.host = v
+				case "proto":
+					element.proto = strings.ToLower(v)
+				}
+			}
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+// splitQuoted splits s on sep outside of quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unquoteForwarded(v string) string {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = v[1 : len(v)-1]
+		return strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(v)
+	}
+	return v
+}
+
+// quoteForwarded quotes values that are not a token, like host:port
+func quoteForwarded(v string) string {
+	for i := 0; i < len(v); i++ {
+		if !isTokenChar(v[i]) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// forwardedNode formats an IP for the for= parameter, IPv6 is bracketed
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return quoteForwarded(ip)
+}
+
+// nodeIP strips the port and brackets off a forwarded address
+func nodeIP(node string) string {
+	return strings.Trim(stripPort(node), "[]")
+}
+
+// splitList splits comma separated header values
+func splitList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// firstValue returns the first item of a comma separated header, or
+// fallback when it is empty
+func firstValue(header, fallback string) string {
+	if first, _, _ := strings.Cut(header, ","); strings.TrimSpace(first) != "" {
+		return strings.ToLower(strings.TrimSpace(first))
+	}
+	return fallback
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// localPort returns the port the client connected to
+func localPort(r *http.Request, listen string) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	_, port, _ := net.SplitHostPort(listen)
+	return port
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func forwardingHandler(t *testing.T, fwd *ForwardingConfig) (http.Handler, *http.Header) {
+	seen := new(http.Header)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*seen = r.Header.Clone()
+	}))
+	t.Cleanup(upstream.Close)
+
+	cl := &ConfigLoader{Config: &Config{
+		Forwarding: fwd,
+		Servers: []ServerConfig{{
+			Listen: ":8080",
+			Host:   "example.com",
+			Routes: []RouteConfig{{Match: RouteMatch{Path: "/"}, Proxy: ProxyConfig{Upstream: []string{upstream.URL}}}},
+		}},
+	}}
+	proxyServers, err := cl.CreateProxyServers()
+	assert.NoError(t, err)
+	t.Cleanup(cl.Stop)
+	return proxyServers[":8080"].HttpHandler, seen
+}
+
+func TestForwarding_UntrustedPeer(t *testing.T) {
+	handler, seen := forwardingHandler(t, nil)
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.10:5555"
+	req.Header.Set("X-Forwarded-For", "6.6.6.6")
+	req.Header.Set("X-Real-IP", "6.6.6.6")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("Forwarded", "for=6.6.6.6")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, []string{"192.0.2.10"}, seen.Values("X-Forwarded-For"), "Expected forged addresses dropped and the peer added once")
+	assert.Equal(t, "192.0.2.10", seen.Get("X-Real-IP"))
+	assert.Equal(t, "http", seen.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "example.com", seen.Get("X-Forwarded-Host"))
+	assert.Equal(t, "8080", seen.Get("X-Forwarded-Port"))
+	assert.Empty(t, seen.Get("Forwarded"))
+}
+
+func TestForwarding_TrustedProxy(t *testing.T) {
+	handler, seen := forwardingHandler(t, &ForwardingConfig{
+		TrustedProxies: []string{"10.0.0.0/8"},
+		Forwarded:      true,
+	})
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 203.0.113.7")
+	req.Header.Add("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "public.example.com")
+	req.Header.Set("Forwarded", `for=203.0.113.7;proto=https`)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, "6.6.6.6, 203.0.113.7, 10.0.0.1, 10.0.0.2", seen.Get("X-Forwarded-For"))
+	assert.Equal(t, "203.0.113.7", seen.Get("X-Real-IP"), "Expected the first untrusted address from the right")
+	assert.Equal(t, "https", seen.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "public.example.com", seen.Get("X-Forwarded-Host"))
+	assert.Equal(t, "443", seen.Get("X-Forwarded-Port"))
+	assert.Equal(t, `for=203.0.113.7;proto=https, for=10.0.0.2;host=example.com;proto=http`, seen.Get("Forwarded"))
+}
+
+func TestForwarding_ClientIP(t *testing.T) {
+	fw, err := newForwarding(&ForwardingConfig{TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"}})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		remote    string
+		xff       string
+		forwarded string
+		want      string
+	}{
+		{"192.0.2.1:1", "203.0.113.7", "", "192.0.2.1"},
+		{"10.0.0.1:1", "", "", "10.0.0.1"},
+		{"10.0.0.1:1", "203.0.113.7, 10.0.0.5", "", "203.0.113.7"},
+		{"10.0.0.1:1", "10.0.0.3, 10.0.0.5", "", "10.0.0.3"},
+		{"10.0.0.1:1", "not-an-ip, 10.0.0.5", "", "10.0.0.5"},
+		{"[2001:db8::1]:1", "", `for="[2001:db8::7]:4711";proto=https, for=10.0.0.2`, "2001:db8::7"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.forwarded != "" {
+			req.Header.Set("Forwarded", tt.forwarded)
+		}
+		assert.Equal(t, tt.want, fw.apply(req, ":80"), "remote %s, xff %q", tt.remote, tt.xff)
+	}
+
+	// the rate limit and hash keys use it
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	info := &requestInfo{clientIP: "203.0.113.7"}
+	req = req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info))
+	assert.Equal(t, "203.0.113.7", clientIP(req))
+}
+
+func TestParseForwarded(t *testing.T) {
+	elements := parseForwarded([]string{`for=192.0.2.60;proto=HTTP;host="a.example:8080", for="_gazonk;x"`, "for=unknown"})
+	assert.Len(t, elements, 3)
+	assert.Equal(t, "192.0.2.60", elements[0].forNode)
+	assert.Equal(t, "http", elements[0].proto)
+	assert.Equal(t, "a.example:8080", elements[0].host)
+	assert.Equal(t, "_gazonk;x", elements[1].forNode)
+	assert.Equal(t, "unknown", elements[2].forNode)
+
+	assert.Equal(t, `"[2001:db8::1]"`, forwardedNode("2001:db8::1"))
+	assert.Equal(t, `"example.com:8443"`, quoteForwarded("example.com:8443"))
+}
+
+func TestForwardingConfig_Validate(t *testing.T) {
+	assert.NoError(t, ForwardingConfig{TrustedProxies: []string{"10.0.0.0/8", "::1", "192.168.1.1"}}.validate())
+	assert.Error(t, ForwardingConfig{TrustedProxies: []string{"10.0.0.0/33"}}.validate())
+	assert.Error(t, ForwardingConfig{TrustedProxies: []string{"proxy.local"}}.validate())
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Virtual nodes per unit of weight. Every md5 digest gives four points on
+// the ring, the same layout as ketama.
+const ringPointsPerWeight = 160
+
+type ringPoint struct {
+	hash   uint32
+	server *UpstreamServer
+}
+
+// hashRing maps keys to servers so that adding or removing one of N servers
+// only moves about 1/N of the keys
+type hashRing struct {
+	points  []ringPoint
+	members []ringMember
+}
+
+// ringMember records what the ring was built from so changes can be detected
+type ringMember struct {
+	server *UpstreamServer
+	weight int32
+}
+
+func newHashRing(servers []*UpstreamServer) *hashRing {
+	ring := &hashRing{members: ringMembers(servers)}
+
+	for _, m := range ring.members {
+		name := m.server.URL.String()
+		for i := 0; i < int(m.weight)*ringPointsPerWeight/4; i++ {
+			digest := md5.Sum([]byte(name + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				ring.points = append(ring.points, ringPoint{
+					hash:   binary.LittleEndian.Uint32(digest[j*4:]),
+					server: m.server,
+				})
+			}
+		}
+	}
+
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+
+	return ring
+}
+
+func ringMembers(servers []*UpstreamServer) []ringMember {
+	members := make([]ringMember, 0, len(servers))
+	for _, server := range servers {
+		weight := atomic.LoadInt32(&server.Weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		members = append(members, ringMember{server: server, weight: weight})
+	}
+	return members
+}
+
+// matches reports whether the ring was built from the same servers and weights
+func (ring *hashRing) matches(servers []*UpstreamServer) bool {
+	members := ringMembers(servers)
+	if len(members) != len(ring.members) {
+		return false
+	}
+	for i := range members {
+		if members[i] != ring.members[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// get returns the server owning key, nil on an empty ring
+func (ring *hashRing) get(key string) *UpstreamServer {
+	return ring.next(key, nil)
+}
+
+// next returns the first server from the owner of key onwards that ok
+// accepts, nil when there is none
+func (ring *hashRing) next(key string, ok func(*UpstreamServer) bool) *UpstreamServer {
+	if len(ring.points) == 0 {
+		return nil
+	}
+
+	digest := md5.Sum([]byte(key))
+	hash := binary.LittleEndian.Uint32(digest[:4])
+
+	i := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i].hash >= hash
+	})
+	for n := 0; n < len(ring.points); n++ {
+		server := ring.points[(i+n)%len(ring.points)].server
+		if ok == nil || ok(server) {
+			return server
+		}
+	}
+	return nil
+}
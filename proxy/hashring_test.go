@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestUpstreams(n int) []*UpstreamServer {
+	servers := make([]*UpstreamServer, 0, n)
+	for i := 0; i < n; i++ {
+		u, _ := url.Parse(fmt.Sprintf("http://localhost:%d", 8081+i))
+		servers = append(servers, newUpstreamServer(u, nil))
+	}
+	return servers
+}
+
+func TestConsistentHashStrategy_MinimalRemap(t *testing.T) {
+	servers := newTestUpstreams(5)
+	strategy := NewStrategy(ConsistentHash)
+
+	const keys = 10000
+	before := make([]*UpstreamServer, keys)
+	for i := 0; i < keys; i++ {
+		before[i] = strategy.NextServer(servers, fmt.Sprintf("client-%d", i))
+	}
+
+	// the same key always lands on the same server
+	assert.Same(t, before[42], strategy.NextServer(servers, "client-42"))
+
+	// one server goes down, only its keys move
+	servers[2].SetAlive(false)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		after := strategy.NextServer(servers, fmt.Sprintf("client-%d", i))
+		assert.NotSame(t, servers[2], after)
+		if before[i] != servers[2] && after != before[i] {
+			t.Fatalf("key client-%d moved from a server that stayed up", i)
+		}
+		if after != before[i] {
+			moved++
+		}
+	}
+	assert.InDelta(t, keys/5, moved, keys/10, "Expected about 1/N of the keys to move, moved %d", moved)
+
+	// the server comes back and gets its keys back
+	servers[2].SetAlive(true)
+	for i := 0; i < keys; i++ {
+		assert.Same(t, before[i], strategy.NextServer(servers, fmt.Sprintf("client-%d", i)))
+	}
+}
+
+func TestConsistentHashStrategy_Weight(t *testing.T) {
+	servers := newTestUpstreams(2)
+	servers[0].Weight = 3
+	servers[1].Weight = 1
+	strategy := NewStrategy(ConsistentHash)
+
+	counts := make(map[*UpstreamServer]int)
+	for i := 0; i < 10000; i++ {
+		counts[strategy.NextServer(servers, fmt.Sprintf("client-%d", i))]++
+	}
+
+	assert.InDelta(t, 7500, counts[servers[0]], 750, "Expected about 3/4 of the keys on the heavier server")
+}
+
+func TestLoadBalancer_RequestKey(t *testing.T) {
+	lb := NewLoadBalancer(newTestUpstreams(1), ConsistentHash)
+
+	req := httptest.NewRequest("GET", "http://example.com/items?page=2", nil)
+	req.RemoteAddr = "10.0.0.1:51234"
+	req.Header.Set("X-User-Id", "alice")
+
+	assert.Equal(t, "10.0.0.1:51234", lb.requestKey(req), "Expected remote address without hash key")
+
+	lb.SetHashKey(HashKeyIP, "")
+	assert.Equal(t, "10.0.0.1", lb.requestKey(req), "Expected client IP without port")
+
+	lb.SetHashKey(HashKeyHeader, "X-User-Id")
+	assert.Equal(t, "alice", lb.requestKey(req))
+
+	lb.SetHashKey(HashKeyCookie, "session")
+	assert.Equal(t, "10.0.0.1", lb.requestKey(req), "Expected client IP when cookie is missing")
+
+	lb.SetHashKey(HashKeyURI, "")
+	assert.Equal(t, "/items?page=2", lb.requestKey(req))
+}
+
+func TestConsistentHashStrategy_RetryKeepsRing(t *testing.T) {
+	servers := newTestUpstreams(3)
+	lb := NewLoadBalancer(servers, ConsistentHash)
+	strategy := lb.strategyHandler.(*ConsistentHashStrategy)
+
+	r := httptest.NewRequest("GET", "http://localhost/", nil)
+	first := lb.getNextServer(r, nil)
+	ring := strategy.ring
+
+	retry := lb.getNextServer(r, map[*UpstreamServer]bool{first: true})
+	assert.NotSame(t, first, retry, "Expected the retry to skip the tried server")
+	assert.Same(t, ring, strategy.ring, "Expected the ring not rebuilt for a retry")
+
+	assert.Same(t, first, lb.getNextServer(r, nil))
+	assert.Same(t, ring, strategy.ring)
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Variables header values may use as ${name}
+var headerVariableNames = map[string]bool{
+	"client_ip":  true,
+	"request_id": true,
+	"host":       true, // Host header sent by the client
+	"route":      true,
+	"upstream":   true,
+	"method":     true,
+	"uri":        true, // as received, before any rewrite
+	"scheme":     true,
+
+	// empty unless the client certificate was verified
+	"client_cert_subject":     true,
+	"client_cert_issuer":      true,
+	"client_cert_san":         true,
+	"client_cert_serial":      true,
+	"client_cert_fingerprint": true,
+	"client_cert":             true, // URL-encoded PEM
+}
+
+// headerRules are compiled HeaderRules
+type headerRules struct {
+	remove   []string // canonical names
+	prefixes []string // canonical prefixes of "Name-*" removals
+	set      []headerOp
+	add      []headerOp
+}
+
+type headerOp struct {
+	name  string
+	value headerValue
+}
+
+// headerValue is a value split into literal text and variables
+type headerValue []headerPart
+
+type headerPart struct {
+	text     string
+	variable bool
+}
+
+func compileHeaderRules(cfg HeaderRules) (*headerRules, error) {
+	rules := &headerRules{}
+
+	for _, name := range cfg.Remove {
+		if prefix, ok := strings.CutSuffix(name, "*"); ok {
+			if prefix != "" && !validHeaderName(prefix) {
+				return nil, fmt.Errorf("invalid header name %q", name)
+			}
+			rules.prefixes = append(rules.prefixes, http.CanonicalHeaderKey(prefix))
+			continue
+		}
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		rules.remove = append(rules.remove, http.CanonicalHeaderKey(name))
+	}
+
+	var err error
+	if rules.set, err = compileHeaderOps(cfg.Set); err != nil {
+		return nil, err
+	}
+	if rules.add, err = compileHeaderOps(cfg.Add); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// compileHeaderOps compiles the values, sorted by name so the order is stable
+func compileHeaderOps(values map[string]string) ([]headerOp, error) {
+	ops := make([]headerOp, 0, len(values))
+	for name, raw := range values {
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		value, err := compileHeaderValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %v", name, err)
+		}
+		ops = append(ops, headerOp{name: http.CanonicalHeaderKey(name), value: value})
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].name < ops[j].name })
+	return ops, nil
+}
+
+func compileHeaderValue(raw string) (headerValue, error) {
+	var value headerValue
+	for raw != "" {
+		start := strings.Index(raw, "${")
+		if start < 0 {
+			value = append(value, headerPart{text: raw})
+			break
+		}
+		end := strings.IndexByte(raw[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated variable in %q", raw)
+		}
+		name := raw[start+2 : start+end]
+		if !headerVariableNames[name] {
+			return nil, fmt.Errorf("unknown variable ${%s}", name)
+		}
+		if start > 0 {
+			value = append(value, headerPart{text: raw[:start]})
+		}
+		value = append(value, headerPart{text: name, variable: true})
+		raw = raw[start+end+1:]
+	}
+	return value, nil
+}
+
+func (v headerValue) expand(lookup func(string) string) string {
+	var b strings.Builder
+	for _, part := range v {
+		if part.variable {
+			b.WriteString(lookup(part.text))
+		} else {
+			b.WriteString(part.text)
+		}
+	}
+	return b.String()
+}
+
+// apply changes h in the order remove, set, add. Values that expand to
+// nothing are not sent, a set still removes the existing values.
+func (rules *headerRules) apply(h http.Header, lookup func(string) string) {
+	for _, name := range rules.remove {
+		h.Del(name)
+	}
+	if len(rules.prefixes) > 0 {
+		for name := range h {
+			for _, prefix := range rules.prefixes {
+				if strings.HasPrefix(name, prefix) {
+					delete(h, name)
+					break
+				}
+			}
+		}
+	}
+	for _, op := range rules.set {
+		if value := op.value.expand(lookup); value != "" {
+			h.Set(op.name, value)
+		} else {
+			h.Del(op.name)
+		}
+	}
+	for _, op := range rules.add {
+		if value := op.value.expand(lookup); value != "" {
+			h.Add(op.name, value)
+		}
+	}
+}
+
+// headerVariables looks up header variables for a request proxied to server
+func headerVariables(r *http.Request, server *UpstreamServer) func(string) string {
+	info := requestInfoFrom(r.Context())
+	return func(name string) string {
+		switch name {
+		case "client_ip":
+			return clientIP(r)
+		case "request_id":
+			if info != nil {
+				return info.ensureRequestID(r)
+			}
+			return r.Header.Get(requestIDHeader)
+		case "host":
+			if info != nil {
+				return info.requestHost
+			}
+			return r.Host
+		case "route":
+			if info != nil {
+				return info.route
+			}
+		case "upstream":
+			return server.URL.String()
+		case "method":
+			return r.Method
+		case "uri":
+			if info != nil {
+				return info.uri
+			}
+			return r.URL.RequestURI()
+		case "scheme":
+			if r.TLS != nil {
+				return "https"
+			}
+			return "http"
+		}
+		return clientCertVariable(name, r)
+	}
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isTokenChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompileHeaderRules(t *testing.T) {
+	value, err := compileHeaderValue("${client_ip} via ${route}!")
+	assert.NoError(t, err)
+	vars := map[string]string{"client_ip": "192.0.2.1", "route": "api"}
+	assert.Equal(t, "192.0.2.1 via api!", value.expand(func(name string) string { return vars[name] }))
+
+	_, err = compileHeaderValue("${nope}")
+	assert.Error(t, err)
+	_, err = compileHeaderValue("${client_ip")
+	assert.Error(t, err)
+	_, err = compileHeaderRules(HeaderRules{Set: map[string]string{"Bad Name": "x"}})
+	assert.Error(t, err)
+	_, err = compileHeaderRules(HeaderRules{Remove: []string{"X-Bad:*"}})
+	assert.Error(t, err)
+
+	rules, err := compileHeaderRules(HeaderRules{
+		Remove: []string{"x-secret", "X-Backend-*"},
+		Set:    map[string]string{"X-Env": "prod"},
+		Add:    map[string]string{"Via": "proxy"},
+	})
+	assert.NoError(t, err)
+
+	h := http.Header{}
+	h.Set("X-Secret", "1")
+	h.Set("X-Backend-Node", "a")
+	h.Set("X-Backend-Pool", "b")
+	h.Set("X-Env", "dev")
+	h.Set("Via", "1.1 cdn")
+	rules.apply(h, func(string) string { return "" })
+	assert.Equal(t, http.Header{"X-Env": {"prod"}, "Via": {"1.1 cdn", "proxy"}}, h)
+
+	// values expanding to nothing are not sent
+	rules, err = compileHeaderRules(HeaderRules{
+		Set: map[string]string{"X-Client-Cert-Subject": "${client_cert_subject}"},
+		Add: map[string]string{"X-Route": "${route}"},
+	})
+	assert.NoError(t, err)
+	h = http.Header{"X-Client-Cert-Subject": {"CN=forged"}}
+	rules.apply(h, func(string) string { return "" })
+	assert.Empty(t, h)
+}
+
+func TestConfigLoader_HeaderRules(t *testing.T) {
+	var seen http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+		w.Header().Set("Server", "nginx/1.25")
+		w.Header().Set("Server-ID", "backend-7")
+		w.Header().Set("X-Backend-Node", "node-3")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	cl := &ConfigLoader{Config: &Config{
+		Servers: []ServerConfig{{
+			Listen:          ":8080",
+			Host:            "example.com",
+			RequestHeaders:  &HeaderRules{Set: map[string]string{"X-Proxy-Id": "edge-1"}},
+			ResponseHeaders: &HeaderRules{Remove: []string{"Server", "Server-ID"}},
+			Routes: []RouteConfig{{
+				Name:  "api",
+				Match: RouteMatch{Path: "/api"},
+				Proxy: ProxyConfig{Upstream: []string{upstream.URL}},
+				RequestHeaders: &HeaderRules{
+					Set:    map[string]string{"X-Client": "${client_ip} ${host} ${route} ${upstream}"},
+					Remove: []string{"Cookie"},
+				},
+				ResponseHeaders: &HeaderRules{
+					Remove: []string{"X-Backend-*"},
+					Set:    map[string]string{"X-Request-ID": "${request_id}"},
+				},
+			}},
+		}},
+	}}
+	proxyServers, err := cl.CreateProxyServers()
+	assert.NoError(t, err)
+	defer cl.Stop()
+
+	req := httptest.NewRequest("GET", "http://example.com/api/items", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Cookie", "session=1")
+	rec := httptest.NewRecorder()
+	proxyServers[":8080"].HttpHandler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "edge-1", seen.Get("X-Proxy-Id"))
+	assert.Equal(t, "192.0.2.1 example.com api "+upstream.URL, seen.Get("X-Client"))
+	assert.Empty(t, seen.Get("Cookie"))
+
+	assert.Empty(t, rec.Header().Get("Server"), "Expected the upstream's Server header hidden")
+	assert.Empty(t, rec.Header().Get("Server-ID"))
+	assert.Empty(t, rec.Header().Get("X-Backend-Node"))
+	assert.Len(t, rec.Header().Get("X-Request-ID"), 32)
+}
+
+func TestProxyServer_HeaderRulesOnRetry(t *testing.T) {
+	var values [][]string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values = append(values, r.Header.Values("X-Added"))
+		if len(values) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+
+	proxyServer := newRetryProxy(t, RetryConfig{Attempts: 2}, first.URL, second.URL)
+	assert.NoError(t, proxyServer.SetHeaders([]*HeaderRules{{Add: map[string]string{"X-Added": "${upstream}"}}}, nil))
+
+	rr := httptest.NewRecorder()
+	proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, values, 2)
+	assert.Len(t, values[1], 1, "Expected headers added once per attempt, not accumulated")
+	assert.NotEqual(t, values[0], values[1], "Expected ${upstream} to follow the retry")
+}
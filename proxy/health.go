@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How much of the response body a health check reads at most
+const maxHealthBody = 64 << 10
+
+// healthProbe is the compiled form of a HealthCheckConfig
+type healthProbe struct {
+	path      string
+	method    string
+	headers   map[string]string
+	statuses  []statusRange
+	body      string
+	bodyRegex *regexp.Regexp
+}
+
+type statusRange struct {
+	min, max int
+}
+
+// parseStatusRange parses "200" or "200-399"
+func parseStatusRange(s string) (statusRange, error) {
+	lo, hi, found := strings.Cut(strings.TrimSpace(s), "-")
+	min, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return statusRange{}, fmt.Errorf("invalid expected status %q", s)
+	}
+
+	max := min
+	if found {
+		if max, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil || max < min {
+			return statusRange{}, fmt.Errorf("invalid expected status %q", s)
+		}
+	}
+
+	return statusRange{min: min, max: max}, nil
+}
+
+func compileHealthProbe(cfg HealthCheckConfig) (*healthProbe, error) {
+	probe := &healthProbe{
+		path:    cfg.Path,
+		method:  strings.ToUpper(cfg.Method),
+		headers: cfg.Headers,
+		body:    cfg.Body,
+	}
+
+	if probe.method == "" {
+		probe.method = http.MethodGet
+	}
+
+	for _, s := range cfg.ExpectedStatus {
+		r, err := parseStatusRange(s)
+		if err != nil {
+			return nil, err
+		}
+		probe.statuses = append(probe.statuses, r)
+	}
+	if len(probe.statuses) == 0 {
+		probe.statuses = []statusRange{{min: 200, max: 299}}
+	}
+
+	if cfg.BodyRegex != "" {
+		re, err := regexp.Compile(cfg.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check body regex %q: %v", cfg.BodyRegex, err)
+		}
+		probe.bodyRegex = re
+	}
+
+	return probe, nil
+}
+
+// SetHealthCheck configures the active health check. It has to be called
+// before Start.
+func (p *ProxyServer) SetHealthCheck(cfg HealthCheckConfig) error {
+	probe, err := compileHealthProbe(cfg)
+	if err != nil {
+		return err
+	}
+	p.probe = probe
+
+	if cfg.Interval > 0 {
+		p.Config.HealthCheckInterval = cfg.Interval
+	}
+	if cfg.UnhealthyInterval > 0 {
+		p.Config.UnhealthyInterval = cfg.UnhealthyInterval
+	}
+	if cfg.Timeout > 0 {
+		p.Config.Timeout = cfg.Timeout
+	}
+	if cfg.Jitter > 0 {
+		p.Config.Jitter = cfg.Jitter
+	}
+	if cfg.Fall > 0 {
+		p.Config.MaxFailCount = cfg.Fall
+	}
+	if cfg.Rise > 0 {
+		p.Config.RiseCount = cfg.Rise
+	}
+
+	return nil
+}
+
+func (p *ProxyServer) checkLoop(ctx context.Context, client *http.Client, server *UpstreamServer) {
+	for {
+		interval := p.Config.HealthCheckInterval
+		if !server.IsAlive() && p.Config.UnhealthyInterval > 0 {
+			interval = p.Config.UnhealthyInterval
+		}
+		if p.Config.Jitter > 0 {
+			interval += time.Duration(rand.Int63n(int64(p.Config.Jitter)))
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		p.checkServer(ctx, client, server)
+	}
+}
+
+// checkServer probes the server once and moves it up or down once the
+// rise or fall threshold is reached
+func (p *ProxyServer) checkServer(ctx context.Context, client *http.Client, server *UpstreamServer) {
+	err := p.probeServer(ctx, client, server)
+
+	// a probe cut short by Stop says nothing about the server
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err != nil {
+		log.Printf("健康檢查失敗 %s: %v", server.URL, err)
+	}
+
+	if server.recordCheck(err == nil, p.Config.RiseCount, p.Config.MaxFailCount) {
+		if server.IsAlive() {
+			log.Printf("Upstream %s is up", server.URL)
+		} else {
+			log.Printf("Upstream %s is down", server.URL)
+		}
+	}
+}
+
+// probeServer sends the health check request and returns why it failed
+func (p *ProxyServer) probeServer(ctx context.Context, client *http.Client, server *UpstreamServer) error {
+	probe := p.probe
+	if probe == nil {
+		probe = &healthProbe{method: http.MethodGet, statuses: []statusRange{{min: 200, max: 299}}}
+	}
+
+	target := *server.URL
+	if probe.path != "" {
+		target.Path, target.RawQuery, _ = strings.Cut(probe.path, "?")
+		target.RawPath = ""
+	}
+
+	req, err := http.NewRequestWithContext(ctx, probe.method, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range probe.headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !probe.statusExpected(resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if probe.body == "" && probe.bodyRegex == nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return err
+	}
+	if probe.body != "" && !strings.Contains(string(body), probe.body) {
+		return fmt.Errorf("body does not contain %q", probe.body)
+	}
+	if probe.bodyRegex != nil && !probe.bodyRegex.Match(body) {
+		return fmt.Errorf("body does not match %q", probe.bodyRegex)
+	}
+
+	return nil
+}
+
+func (probe *healthProbe) statusExpected(status int) bool {
+	for _, r := range probe.statuses {
+		if status >= r.min && status <= r.max {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// hostRouter finds the routes of a listener for a request host. Exact names
+// win over wildcards (longest suffix first), then regexes in config order,
+// then the default server.
+type hostRouter struct {
+	exact      map[string][]THostServer
+	wildcards  []hostPattern
+	regexes    []hostPattern
+	fallback   []THostServer
+	hasDefault bool
+}
+
+type hostPattern struct {
+	suffix string
+	regex  *regexp.Regexp
+	routes []THostServer
+}
+
+func newHostRouter() *hostRouter {
+	return &hostRouter{exact: make(map[string][]THostServer)}
+}
+
+// isWildcardHost reports whether name is a leading wildcard like *.example.com
+func isWildcardHost(name string) bool {
+	return strings.HasPrefix(name, "*.")
+}
+
+// isRegexHost reports whether name is a regex, written with a leading ~
+func isRegexHost(name string) bool {
+	return strings.HasPrefix(name, "~")
+}
+
+// stripPort removes the port from a host, if any
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// normalizeHost makes config names and request hosts comparable
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(stripPort(host), "."))
+}
+
+func compileHostRegex(name string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(name[1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid host regex %q: %v", name, err)
+	}
+	return re, nil
+}
+
+// add registers routes under every name of the server
+func (hr *hostRouter) add(names []string, isDefault bool, routes []THostServer) error {
+	for _, name := range names {
+		switch {
+		case isRegexHost(name):
+			re, err := compileHostRegex(name)
+			if err != nil {
+				return err
+			}
+			hr.regexes = append(hr.regexes, hostPattern{regex: re, routes: routes})
+		case isWildcardHost(name):
+			// keep the dot so *.example.com does not match example.com
+			hr.wildcards = append(hr.wildcards, hostPattern{suffix: normalizeHost(name[1:]), routes: routes})
+		default:
+			hr.exact[normalizeHost(name)] = routes
+		}
+	}
+
+	if isDefault {
+		hr.fallback = routes
+		hr.hasDefault = true
+	}
+
+	sort.SliceStable(hr.wildcards, func(i, j int) bool {
+		return len(hr.wildcards[i].suffix) > len(hr.wildcards[j].suffix)
+	})
+
+	return nil
+}
+
+// lookup returns the routes serving host
+func (hr *hostRouter) lookup(host string) ([]THostServer, bool) {
+	host = normalizeHost(host)
+
+	if routes, ok := hr.exact[host]; ok {
+		return routes, true
+	}
+
+	for _, p := range hr.wildcards {
+		if strings.HasSuffix(host, p.suffix) && len(host) > len(p.suffix) {
+			return p.routes, true
+		}
+	}
+
+	for _, p := range hr.regexes {
+		if p.regex.MatchString(host) {
+			return p.routes, true
+		}
+	}
+
+	return hr.fallback, hr.hasDefault
+}
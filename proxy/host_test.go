@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostRouter_Lookup(t *testing.T) {
+	routes := func(name string) []THostServer {
+		return []THostServer{{match: &routeMatcher{path: name}}}
+	}
+
+	hr := newHostRouter()
+	assert.NoError(t, hr.add([]string{"example.com", "www.example.com:443"}, false, routes("exact")))
+	assert.NoError(t, hr.add([]string{"*.example.com"}, false, routes("wildcard")))
+	assert.NoError(t, hr.add([]string{"*.api.example.com"}, false, routes("api-wildcard")))
+	assert.NoError(t, hr.add([]string{`~^shop[0-9]+\.test\.com$`}, false, routes("regex")))
+
+	tests := []struct {
+		host     string
+		expected string
+		found    bool
+	}{
+		{host: "example.com", expected: "exact", found: true},
+		{host: "example.com:443", expected: "exact", found: true},
+		{host: "WWW.Example.com", expected: "exact", found: true},
+		{host: "blog.example.com", expected: "wildcard", found: true},
+		{host: "a.b.example.com:8080", expected: "wildcard", found: true},
+		{host: "v1.api.example.com", expected: "api-wildcard", found: true},
+		{host: "shop12.test.com", expected: "regex", found: true},
+		{host: "shop.test.com", found: false},
+		{host: "notexample.com", found: false},
+	}
+
+	for _, tt := range tests {
+		routes, found := hr.lookup(tt.host)
+		assert.Equal(t, tt.found, found, "host %s", tt.host)
+		if tt.found {
+			assert.Equal(t, tt.expected, routes[0].match.path, "host %s", tt.host)
+		}
+	}
+
+	// the default server takes every host nothing else matches
+	assert.NoError(t, hr.add([]string{"fallback.com"}, true, routes("default")))
+	found, ok := hr.lookup("unknown.org")
+	assert.True(t, ok, "Expected default server to match")
+	assert.Equal(t, "default", found[0].match.path)
+}
@@ -2,7 +2,17 @@ package proxy
 
 import (
 	"fmt"
+	"net/http"
 	"sync"
+	"sync/atomic"
+)
+
+// Hash key sources for consistent hashing
+const (
+	HashKeyIP     = "ip"
+	HashKeyHeader = "header"
+	HashKeyCookie = "cookie"
+	HashKeyURI    = "uri"
 )
 
 // LoadBalancer 負載均衡器
@@ -12,6 +22,11 @@ type LoadBalancer struct {
 	// 負載均衡策略函數
 	strategy        Strategy
 	strategyHandler StrategyHandler
+	// what part of the request is hashed, empty hashes the remote address
+	hashKeySource string
+	hashKeyName   string
+	// affinity cookie, tried before the strategy when set
+	sticky *stickySession
 }
 
 func NewLoadBalancer(servers []*UpstreamServer, strategy Strategy) *LoadBalancer {
@@ -31,11 +46,102 @@ func (lb *LoadBalancer) UpdateStrategy(strategy Strategy) {
 	lb.strategyHandler = NewStrategy(strategy)
 }
 
-// GetNextServer returns the next server based on the current strategy
-func (lb *LoadBalancer) GetNextServer(remoteAddr string) *UpstreamServer {
+// SetHashKey sets what part of the request the strategy hashes. name is the
+// header or cookie name for those sources.
+func (lb *LoadBalancer) SetHashKey(source string, name string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.hashKeySource = source
+	lb.hashKeyName = name
+}
+
+// SetStickySession enables cookie based session affinity
+func (lb *LoadBalancer) SetStickySession(cfg StickyConfig) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.sticky = newStickySession(cfg)
+}
+
+// GetNextServer returns the server named by the affinity cookie while it is
+// alive, otherwise the next server based on the current strategy
+func (lb *LoadBalancer) GetNextServer(r *http.Request) *UpstreamServer {
+	return lb.getNextServer(r, nil)
+}
+
+// getNextServer is GetNextServer avoiding the servers in tried, unless
+// nothing else is left
+func (lb *LoadBalancer) getNextServer(r *http.Request, tried map[*UpstreamServer]bool) *UpstreamServer {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	servers := lb.servers
+	var skip map[*UpstreamServer]bool
+	if len(tried) > 0 {
+		var untried []*UpstreamServer
+		for _, server := range lb.servers {
+			if !tried[server] {
+				untried = append(untried, server)
+			}
+		}
+		if len(getAliveServers(untried)) > 0 {
+			servers = untried
+			skip = tried
+		}
+	}
+
+	if lb.sticky != nil {
+		if server := lb.sticky.lookup(r, servers); server != nil {
+			return server
+		}
+	}
+
+	if s, ok := lb.strategyHandler.(skippingStrategy); ok {
+		return s.nextServerSkipping(lb.servers, lb.requestKey(r), skip)
+	}
+	return lb.strategyHandler.NextServer(servers, lb.requestKey(r))
+}
+
+// hasHealthyServers reports whether any server could take requests once it
+// has a free connection
+func (lb *LoadBalancer) hasHealthyServers() bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return len(getHealthyServers(lb.servers)) > 0
+}
+
+// AffinityCookie returns the cookie pinning the client to server, nil when
+// sticky sessions are off or the client already has it
+func (lb *LoadBalancer) AffinityCookie(r *http.Request, server *UpstreamServer) *http.Cookie {
 	lb.mu.RLock()
 	defer lb.mu.RUnlock()
-	return lb.strategyHandler.NextServer(lb.servers, remoteAddr)
+
+	if lb.sticky == nil {
+		return nil
+	}
+	return lb.sticky.cookie(r, server)
+}
+
+// requestKey returns the key handed to the strategy. Header and cookie keys
+// fall back to the client IP when missing.
+func (lb *LoadBalancer) requestKey(r *http.Request) string {
+	switch lb.hashKeySource {
+	case HashKeyIP:
+		return clientIP(r)
+	case HashKeyHeader:
+		if v := r.Header.Get(lb.hashKeyName); v != "" {
+			return v
+		}
+		return clientIP(r)
+	case HashKeyCookie:
+		if c, err := r.Cookie(lb.hashKeyName); err == nil && c.Value != "" {
+			return c.Value
+		}
+		return clientIP(r)
+	case HashKeyURI:
+		return r.URL.RequestURI()
+	default:
+		return r.RemoteAddr
+	}
 }
 
 // SetServerWeight sets the weight for weighted round-robin
@@ -45,7 +151,7 @@ func (lb *LoadBalancer) SetServerWeight(serverURL string, weight int32) error {
 
 	for _, server := range lb.servers {
 		if server.URL.String() == serverURL {
-			server.Weight = weight
+			atomic.StoreInt32(&server.Weight, weight)
 			return nil
 		}
 	}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PathType decides how RouteMatch.Path is compared with the request path
+type PathType string
+
+const (
+	PathPrefix PathType = "prefix"
+	PathExact  PathType = "exact"
+	PathRegex  PathType = "regex"
+)
+
+// routeMatcher is the compiled form of a RouteMatch
+type routeMatcher struct {
+	pathType  PathType
+	path      string
+	pathRegex *regexp.Regexp
+	methods   map[string]bool
+	headers   []valueMatcher
+	query     []valueMatcher
+	cookies   []valueMatcher
+	priority  int
+}
+
+// valueMatcher matches a named header, query parameter or cookie. Without a
+// value or regex only the presence of the name is checked.
+type valueMatcher struct {
+	name  string
+	value string
+	regex *regexp.Regexp
+}
+
+func compileRouteMatch(m RouteMatch) (*routeMatcher, error) {
+	rm := &routeMatcher{
+		pathType: m.PathType,
+		path:     m.Path,
+		priority: m.Priority,
+	}
+
+	switch rm.pathType {
+	case "":
+		rm.pathType = PathPrefix
+	case PathPrefix, PathExact:
+	case PathRegex:
+		re, err := regexp.Compile(m.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regex %q: %v", m.Path, err)
+		}
+		rm.pathRegex = re
+	default:
+		return nil, fmt.Errorf("unknown path type %q", m.PathType)
+	}
+
+	if len(m.Methods) > 0 {
+		rm.methods = make(map[string]bool, len(m.Methods))
+		for _, method := range m.Methods {
+			rm.methods[strings.ToUpper(method)] = true
+		}
+	}
+
+	var err error
+	if rm.headers, err = compileValueMatches("header", m.Headers); err != nil {
+		return nil, err
+	}
+	if rm.query, err = compileValueMatches("query", m.Query); err != nil {
+		return nil, err
+	}
+	if rm.cookies, err = compileValueMatches("cookie", m.Cookies); err != nil {
+		return nil, err
+	}
+
+	return rm, nil
+}
+
+func compileValueMatches(kind string, matches []ValueMatch) ([]valueMatcher, error) {
+	matchers := make([]valueMatcher, 0, len(matches))
+	for _, m := range matches {
+		if m.Name == "" {
+			return nil, fmt.Errorf("%s match without name", kind)
+		}
+
+		vm := valueMatcher{name: m.Name, value: m.Value}
+		if m.Regex != "" {
+			re, err := regexp.Compile(m.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s regex %q: %v", kind, m.Regex, err)
+			}
+			vm.regex = re
+		}
+		matchers = append(matchers, vm)
+	}
+	return matchers, nil
+}
+
+// matches reports whether the request satisfies every condition of the route
+func (rm *routeMatcher) matches(r *http.Request) bool {
+	switch rm.pathType {
+	case PathExact:
+		if r.URL.Path != rm.path {
+			return false
+		}
+	case PathRegex:
+		if !rm.pathRegex.MatchString(r.URL.Path) {
+			return false
+		}
+	default:
+		if !strings.HasPrefix(r.URL.Path, rm.path) {
+			return false
+		}
+	}
+
+	if rm.methods != nil && !rm.methods[r.Method] {
+		return false
+	}
+
+	for _, vm := range rm.headers {
+		if !vm.matchesAny(r.Header.Values(vm.name)) {
+			return false
+		}
+	}
+
+	if len(rm.query) > 0 {
+		query := r.URL.Query()
+		for _, vm := range rm.query {
+			if !vm.matchesAny(query[vm.name]) {
+				return false
+			}
+		}
+	}
+
+	for _, vm := range rm.cookies {
+		cookie, err := r.Cookie(vm.name)
+		if err != nil || !vm.matchesAny([]string{cookie.Value}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (vm valueMatcher) matchesAny(values []string) bool {
+	for _, v := range values {
+		switch {
+		case vm.regex != nil:
+			if vm.regex.MatchString(v) {
+				return true
+			}
+		case vm.value != "":
+			if v == vm.value {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// pathRank orders path types from least to most specific
+func (rm *routeMatcher) pathRank() int {
+	switch rm.pathType {
+	case PathExact:
+		return 2
+	case PathRegex:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (rm *routeMatcher) conditions() int {
+	return len(rm.methods) + len(rm.headers) + len(rm.query) + len(rm.cookies)
+}
+
+// moreSpecific reports whether rm should be tried before other. An explicit
+// priority wins, then exact paths over regex over prefix paths, then the
+// longer path, then the route with more conditions.
+func (rm *routeMatcher) moreSpecific(other *routeMatcher) bool {
+	if rm.priority != other.priority {
+		return rm.priority > other.priority
+	}
+	if rm.pathRank() != other.pathRank() {
+		return rm.pathRank() > other.pathRank()
+	}
+	if len(rm.path) != len(other.path) {
+		return len(rm.path) > len(other.path)
+	}
+	return rm.conditions() > other.conditions()
+}
+
+// sortHostServers orders the routes of a host so the first match is the most
+// specific one. Routes that tie keep their config order.
+func sortHostServers(hostServers []THostServer) {
+	sort.SliceStable(hostServers, func(i, j int) bool {
+		return hostServers[i].match.moreSpecific(hostServers[j].match)
+	})
+}
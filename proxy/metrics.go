@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the request duration histogram, in seconds
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics holds the request counters of every route. Series are keyed by
+// their labels, so they survive reloads and their number is bounded by the
+// configured routes. Series of routes gone from the config are dropped on
+// reload.
+type metrics struct {
+	mu     sync.Mutex
+	routes map[string]*routeMetrics
+}
+
+func newMetrics() *metrics {
+	return &metrics{routes: make(map[string]*routeMetrics)}
+}
+
+// route returns the counters of a route, creating them on first use
+func (m *metrics) route(listener string, host string, route string) *routeMetrics {
+	labels := formatLabels("listener", listener, "host", host, "route", route)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rm, ok := m.routes[labels]; ok {
+		return rm
+	}
+	rm := &routeMetrics{
+		listener:  listener,
+		host:      host,
+		route:     route,
+		labels:    labels,
+		upstreams: make(map[string]*upstreamMetrics),
+	}
+	m.routes[labels] = rm
+	return rm
+}
+
+// retain drops the counters of routes that are not in cfg
+func (m *metrics) retain(cfg *Config) {
+	keep := configuredRoutes(cfg)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for labels := range m.routes {
+		if !keep[labels] {
+			delete(m.routes, labels)
+		}
+	}
+}
+
+// configuredRoutes returns the labels of every route of cfg
+func configuredRoutes(cfg *Config) map[string]bool {
+	routes := make(map[string]bool)
+	for _, server := range cfg.Servers {
+		for _, label := range routeLabels(server) {
+			routes[formatLabels("listener", server.Listen, "host", server.HostNames()[0], "route", label)] = true
+		}
+	}
+	return routes
+}
+
+// routeLabels returns the route label of every route of server. Routes are
+// labelled by their name or match path, a label already taken by an earlier
+// route of the server gets the route index appended.
+func routeLabels(server ServerConfig) []string {
+	labels := make([]string, len(server.Routes))
+	taken := make(map[string]bool)
+	for i, route := range server.Routes {
+		label := route.Label()
+		if taken[label] {
+			label = fmt.Sprintf("%s#%d", label, i)
+		}
+		taken[label] = true
+		labels[i] = label
+	}
+	return labels
+}
+
+type routeMetrics struct {
+	listener string
+	host     string
+	route    string
+	labels   string
+
+	mu        sync.Mutex
+	upstreams map[string]*upstreamMetrics
+	retries   uint64
+	bytesIn   uint64
+	bytesOut  uint64
+}
+
+type upstreamMetrics struct {
+	requests map[string]uint64 // by status class
+	buckets  []uint64
+	count    uint64
+	sum      float64
+}
+
+// observe records a finished request
+func (rm *routeMetrics) observe(info *requestInfo, status int, bytesOut int64) {
+	seconds := time.Since(info.start).Seconds()
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	um, ok := rm.upstreams[info.upstream]
+	if !ok {
+		um = &upstreamMetrics{
+			requests: make(map[string]uint64),
+			buckets:  make([]uint64, len(durationBuckets)),
+		}
+		rm.upstreams[info.upstream] = um
+	}
+	um.requests[statusClass(status)]++
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			um.buckets[i]++
+		}
+	}
+	um.count++
+	um.sum += seconds
+
+	rm.retries += uint64(info.retries)
+	rm.bytesIn += uint64(info.bytesIn.Load())
+	rm.bytesOut += uint64(bytesOut)
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// metricFamily collects the samples of one metric for the text format
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples []string
+}
+
+func (f *metricFamily) add(name string, labels string, value float64) {
+	f.samples = append(f.samples, fmt.Sprintf("%s{%s} %s", name, labels, strconv.FormatFloat(value, 'g', -1, 64)))
+}
+
+func (f *metricFamily) write(w io.Writer) {
+	if len(f.samples) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	for _, sample := range f.samples {
+		fmt.Fprintln(w, sample)
+	}
+}
+
+// writeMetrics writes the request counters and the state of the upstream
+// servers of cfg in the Prometheus text format
+func (m *metrics) writeMetrics(w io.Writer, cfg *Config, proxies map[string]*ProxyServer) {
+	requests := &metricFamily{name: "proxy_requests_total", help: "Requests by status class.", kind: "counter"}
+	duration := &metricFamily{name: "proxy_request_duration_seconds", help: "Request duration including retries.", kind: "histogram"}
+	retries := &metricFamily{name: "proxy_retries_total", help: "Requests sent again to another upstream.", kind: "counter"}
+	bytesIn := &metricFamily{name: "proxy_request_bytes_total", help: "Request body bytes read from clients.", kind: "counter"}
+	bytesOut := &metricFamily{name: "proxy_response_bytes_total", help: "Response body bytes written to clients.", kind: "counter"}
+
+	// a reload that failed may have left counters of routes never served
+	configured := configuredRoutes(cfg)
+	m.mu.Lock()
+	routes := make([]*routeMetrics, 0, len(m.routes))
+	for labels, rm := range m.routes {
+		if configured[labels] {
+			routes = append(routes, rm)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(routes, func(i, j int) bool { return routes[i].labels < routes[j].labels })
+
+	for _, rm := range routes {
+		rm.mu.Lock()
+		upstreams := make([]string, 0, len(rm.upstreams))
+		for upstream := range rm.upstreams {
+			upstreams = append(upstreams, upstream)
+		}
+		sort.Strings(upstreams)
+
+		for _, upstream := range upstreams {
+			um := rm.upstreams[upstream]
+			labels := rm.labels + "," + formatLabels("upstream", upstream)
+
+			classes := make([]string, 0, len(um.requests))
+			for class := range um.requests {
+				classes = append(classes, class)
+			}
+			sort.Strings(classes)
+			for _, class := range classes {
+				requests.add(requests.name, labels+","+formatLabels("code", class), float64(um.requests[class]))
+			}
+
+			for i, le := range durationBuckets {
+				duration.add(duration.name+"_bucket", labels+","+formatLabels("le", strconv.FormatFloat(le, 'g', -1, 64)), float64(um.buckets[i]))
+			}
+			duration.add(duration.name+"_bucket", labels+","+formatLabels("le", "+Inf"), float64(um.count))
+			duration.add(duration.name+"_sum", labels, um.sum)
+			duration.add(duration.name+"_count", labels, float64(um.count))
+		}
+
+		retries.add(retries.name, rm.labels, float64(rm.retries))
+		bytesIn.add(bytesIn.name, rm.labels, float64(rm.bytesIn))
+		bytesOut.add(bytesOut.name, rm.labels, float64(rm.bytesOut))
+		rm.mu.Unlock()
+	}
+
+	active := &metricFamily{name: "proxy_upstream_active_connections", help: "Requests in flight to the upstream server.", kind: "gauge"}
+	up := &metricFamily{name: "proxy_upstream_up", help: "Whether the active health check considers the upstream server up.", kind: "gauge"}
+	fails := &metricFamily{name: "proxy_upstream_health_check_failures", help: "Consecutive failed health checks.", kind: "gauge"}
+	circuitOpen := &metricFamily{name: "proxy_upstream_circuit_open", help: "Whether the circuit breaker of the upstream server is open.", kind: "gauge"}
+
+	for _, server := range cfg.Servers {
+		names := routeLabels(server)
+		for i, route := range server.Routes {
+			px, ok := proxies[routeKey(server, route)]
+			if !ok {
+				continue
+			}
+			series := formatLabels("listener", server.Listen, "host", server.HostNames()[0], "route", names[i])
+
+			px.LoadBalancer.mu.RLock()
+			for _, us := range px.LoadBalancer.servers {
+				labels := series + "," + formatLabels("upstream", us.URL.String())
+				active.add(active.name, labels, float64(atomic.LoadInt32(&us.ActiveConns)))
+				up.add(up.name, labels, boolValue(us.IsAlive()))
+				fails.add(fails.name, labels, float64(us.FailCount()))
+				circuitOpen.add(circuitOpen.name, labels, boolValue(us.CircuitState() == CircuitOpen))
+			}
+			px.LoadBalancer.mu.RUnlock()
+		}
+	}
+
+	for _, f := range []*metricFamily{requests, duration, retries, bytesIn, bytesOut, active, up, fails, circuitOpen} {
+		f.write(w)
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders name, value pairs as Prometheus labels
+func formatLabels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	return b.String()
+}
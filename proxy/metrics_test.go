@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigLoader_Metrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	cl := &ConfigLoader{Config: &Config{
+		Admin: &AdminConfig{Listen: "127.0.0.1:9100"},
+		Servers: []ServerConfig{{
+			Listen: ":8080",
+			Host:   "example.com",
+			Routes: []RouteConfig{
+				{Name: "api", Match: RouteMatch{Path: "/api"}, Proxy: ProxyConfig{
+					Upstream:  []string{upstream.URL},
+					RateLimit: &RateLimitConfig{Requests: 3, Period: 3600e9},
+				}},
+			},
+		}},
+	}}
+
+	proxyServers, err := cl.CreateProxyServers()
+	assert.NoError(t, err)
+	defer cl.Stop()
+	handler := proxyServers[":8080"].HttpHandler
+
+	for _, path := range []string{"/api/a", "/api/b", "/api/missing", "/api/limited", "/unrouted"} {
+		req := httptest.NewRequest("POST", "http://example.com"+path, strings.NewReader("body"))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rec := httptest.NewRecorder()
+	cl.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "http://127.0.0.1:9100/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+
+	route := `listener=":8080",host="example.com",route="api"`
+	labels := route + `,upstream="` + upstream.URL + `"`
+	for _, line := range []string{
+		"# TYPE proxy_requests_total counter",
+		`proxy_requests_total{` + labels + `,code="2xx"} 2`,
+		`proxy_requests_total{` + labels + `,code="4xx"} 1`,
+		`proxy_requests_total{` + route + `,upstream="",code="4xx"} 1`,
+		`proxy_request_duration_seconds_bucket{` + labels + `,le="+Inf"} 3`,
+		`proxy_request_duration_seconds_count{` + labels + `} 3`,
+		`proxy_request_bytes_total{` + route + `} 12`,
+		`proxy_response_bytes_total{` + route + `} 28`, // two bodies and the 429 message
+		`proxy_retries_total{` + route + `} 0`,
+		`proxy_upstream_active_connections{` + labels + `} 0`,
+		`proxy_upstream_up{` + labels + `} 1`,
+		`proxy_upstream_health_check_failures{` + labels + `} 0`,
+		`proxy_upstream_circuit_open{` + labels + `} 0`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+	assert.NotContains(t, body, "/unrouted", "Expected raw paths to stay out of the labels")
+
+	rec = httptest.NewRecorder()
+	cl.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "http://127.0.0.1:9100/other", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestConfigLoader_MetricsRouteLabels(t *testing.T) {
+	config := `
+admin:
+  listen: "127.0.0.1:9100"
+servers:
+  - listen: ":8080"
+    host: "example.com"
+    routes:
+      - match:
+          path: "/api"
+          methods: ["GET"]
+        proxy:
+          upstream: ["http://localhost:8081"]
+      - match:
+          path: "/api"
+        proxy:
+          upstream: ["http://localhost:8082"]
+`
+	filename := filepath.Join(t.TempDir(), "setting.yaml")
+	writeConfigFile(t, filename, config)
+	cl, err := NewConfigLoader(filename)
+	assert.NoError(t, err)
+	proxyServers, err := cl.CreateProxyServers()
+	assert.NoError(t, err)
+	defer cl.Stop()
+
+	handler := proxyServers[":8080"].HttpHandler
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://example.com/api", nil))
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		cl.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "http://127.0.0.1:9100/metrics", nil))
+		return rec.Body.String()
+	}
+
+	body := scrape()
+	first := `listener=":8080",host="example.com",route="/api"`
+	second := `listener=":8080",host="example.com",route="/api#1"`
+	assert.Contains(t, body, `proxy_upstream_up{`+first+`,upstream="http://localhost:8081"}`)
+	assert.Contains(t, body, `proxy_upstream_up{`+second+`,upstream="http://localhost:8082"}`, "Expected every route's upstreams exported")
+	assert.Contains(t, body, `proxy_response_bytes_total{`+first+`} 0`+"\n", "Expected the routes kept apart")
+	assert.NotContains(t, body, `proxy_response_bytes_total{`+second+`} 0`+"\n")
+
+	// the second route is gone after the reload, and so are its series
+	writeConfigFile(t, filename, config[:strings.LastIndex(config, "      - match:")])
+	_, _, err = cl.Reload()
+	assert.NoError(t, err)
+	assert.NotContains(t, scrape(), second)
+	assert.Len(t, cl.metrics.routes, 1, "Expected the removed route pruned")
+}
+
+func TestFormatLabels(t *testing.T) {
+	assert.Equal(t, `route="a\"b\\c\n"`, formatLabels("route", "a\"b\\c\n"))
+	assert.Equal(t, `listener=":443",host="example.com"`, formatLabels("listener", ":443", "host", "example.com"))
+}
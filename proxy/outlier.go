@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Defaults for outlier detection when the config leaves a field empty
+const (
+	defaultConsecutiveErrors  = 5
+	defaultBaseEjectionTime   = 30 * time.Second
+	defaultMaxEjectionTime    = 300 * time.Second
+	defaultMaxEjectionPercent = 50
+)
+
+// outlierDetector ejects upstream servers that keep failing real traffic,
+// without waiting for the next active health check
+type outlierDetector struct {
+	consecutiveErrors  int32
+	baseEjectionTime   time.Duration
+	maxEjectionTime    time.Duration
+	maxEjectionPercent int
+
+	mu sync.Mutex
+}
+
+func newOutlierDetector(cfg OutlierConfig) *outlierDetector {
+	od := &outlierDetector{
+		consecutiveErrors:  int32(cfg.ConsecutiveErrors),
+		baseEjectionTime:   cfg.BaseEjectionTime,
+		maxEjectionTime:    cfg.MaxEjectionTime,
+		maxEjectionPercent: cfg.MaxEjectionPercent,
+	}
+
+	if od.consecutiveErrors <= 0 {
+		od.consecutiveErrors = defaultConsecutiveErrors
+	}
+	if od.baseEjectionTime <= 0 {
+		od.baseEjectionTime = defaultBaseEjectionTime
+	}
+	if od.maxEjectionTime <= 0 {
+		od.maxEjectionTime = defaultMaxEjectionTime
+	}
+	if od.maxEjectionPercent <= 0 {
+		od.maxEjectionPercent = defaultMaxEjectionPercent
+	}
+
+	return od
+}
+
+// record feeds the outcome of one proxied request for server, servers is
+// the whole pool the server belongs to
+func (od *outlierDetector) record(server *UpstreamServer, servers []*UpstreamServer, failed bool) {
+	if !failed {
+		server.consecutiveErrors.Store(0)
+		// forget past ejections once the server behaved for a while
+		if until := server.ejectedUntil.Load(); until != 0 && time.Since(time.Unix(0, until)) > od.maxEjectionTime {
+			server.ejections.Store(0)
+		}
+		return
+	}
+
+	if server.consecutiveErrors.Add(1) < od.consecutiveErrors {
+		return
+	}
+
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	if server.Ejected() {
+		return
+	}
+
+	ejected := 0
+	for _, s := range servers {
+		if s.Ejected() {
+			ejected++
+		}
+	}
+
+	// never empty the pool on passive signals alone
+	if ejected+1 >= len(servers) || (ejected+1)*100 > len(servers)*od.maxEjectionPercent {
+		log.Printf("Outlier %s not ejected, %d of %d servers already ejected", server.URL, ejected, len(servers))
+		return
+	}
+
+	// the ejection grows with every repeated ejection
+	ejections := server.ejections.Add(1)
+	duration := od.baseEjectionTime * time.Duration(ejections)
+	if duration > od.maxEjectionTime {
+		duration = od.maxEjectionTime
+	}
+
+	server.ejectedUntil.Store(time.Now().Add(duration).UnixNano())
+	server.consecutiveErrors.Store(0)
+	log.Printf("Outlier %s ejected for %v after %d consecutive errors", server.URL, duration, od.consecutiveErrors)
+}
@@ -1,26 +1,104 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// UpstreamServer 代表一個上游伺服器
+// UpstreamServer 代表一個上游伺服器. Its state is only touched through
+// atomics, so strategies can read it while health checks update it.
 type UpstreamServer struct {
 	URL          *url.URL
-	Alive        bool
-	LastChecked  time.Time
-	FailCount    int
 	ReverseProxy *httputil.ReverseProxy
 
-	// New fields for enhanced strategies
+	// New fields for enhanced strategies, accessed atomically
 	Weight        int32 // for weighted round-robin
 	CurrentWeight int32 // for weighted round-robin
-	ActiveConns   int32 // for least connections
+	ActiveConns   int32 // for least connections and max_conns
+	MaxConns      int32 // 0 is unlimited
+
+	// active health checking
+	alive        atomic.Bool
+	failCount    atomic.Int32
+	successCount atomic.Int32
+	lastChecked  atomic.Int64 // unix nano
+
+	// passive health checking
+	consecutiveErrors atomic.Int32
+	ejections         atomic.Int32
+	ejectedUntil      atomic.Int64 // unix nano
+
+	// circuit breaker
+	circuit circuit
+
+	// requests waiting for a connection, woken when one is released
+	queue atomic.Pointer[connQueue]
+}
+
+func newUpstreamServer(upstreamURL *url.URL, proxy *httputil.ReverseProxy) *UpstreamServer {
+	server := &UpstreamServer{
+		URL:          upstreamURL,
+		ReverseProxy: proxy,
+	}
+	server.alive.Store(true)
+	return server
+}
+
+// IsAlive reports whether the active health check considers the server up
+func (s *UpstreamServer) IsAlive() bool {
+	return s.alive.Load()
+}
+
+// SetAlive marks the server up or down
+func (s *UpstreamServer) SetAlive(alive bool) {
+	s.alive.Store(alive)
+}
+
+// FailCount returns the number of consecutive failed health checks
+func (s *UpstreamServer) FailCount() int {
+	return int(s.failCount.Load())
+}
+
+// LastChecked returns when the server was last health checked
+func (s *UpstreamServer) LastChecked() time.Time {
+	if t := s.lastChecked.Load(); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// recordCheck feeds one health check result into the up/down state machine.
+// A down server comes up after rise passed checks in a row, an up server goes
+// down after fall failed checks in a row. It reports whether the state changed.
+func (s *UpstreamServer) recordCheck(ok bool, rise int, fall int) bool {
+	s.lastChecked.Store(time.Now().UnixNano())
+
+	if !ok {
+		s.successCount.Store(0)
+		if int(s.failCount.Add(1)) >= fall {
+			return s.alive.Swap(false)
+		}
+		return false
+	}
+
+	s.failCount.Store(0)
+	if int(s.successCount.Add(1)) >= rise {
+		return !s.alive.Swap(true)
+	}
+	return false
+}
+
+// Ejected reports whether outlier detection took the server out of rotation
+func (s *UpstreamServer) Ejected() bool {
+	return time.Now().UnixNano() < s.ejectedUntil.Load()
 }
 
 // ProxyServer 反向代理伺服器
@@ -28,13 +106,61 @@ type ProxyServer struct {
 	LoadBalancer *LoadBalancer
 	Config       struct {
 		HealthCheckInterval time.Duration
-		MaxFailCount        int
+		UnhealthyInterval   time.Duration // probe interval while a server is down, HealthCheckInterval when empty
+		Jitter              time.Duration // random delay added to every interval
+		MaxFailCount        int           // failed checks before a server is marked down
+		RiseCount           int           // passed checks before a down server is marked up
 		Timeout             time.Duration
 	}
+
+	// what the health check requests and expects, nil gets the upstream root
+	// and expects a 2xx
+	probe *healthProbe
+
+	// nil when passive health checking is off
+	outlier *outlierDetector
+	// nil when failed requests are not retried
+	retry *retryPolicy
+	// nil when the circuit breaker is off
+	breaker *circuitBreaker
+	// concurrent requests per upstream server, written to the upstream
+	// servers by commitUpstreams. 0 is unlimited.
+	maxConns int32
+	// nil when requests are rejected right away at max_conns
+	queue *connQueue
+	// nil when request bodies are streamed
+	buffer *bodyBuffer
+	// rate limits of the server and of the route, nil when not set. Kept
+	// here so a reload can hand them to the next proxy of the route.
+	serverLimit *rateLimiter
+	routeLimit  *rateLimiter
+	// weights of the route by upstream URL, written to the upstream servers
+	// by commitUpstreams. nil leaves the weights alone.
+	weights map[string]int32
+	// header rules of the server, then of the route
+	requestHeaders  []*headerRules
+	responseHeaders []*headerRules
+
+	// nil uses the default transport
+	transport      *http.Transport
+	requestTimeout time.Duration
+	streamIdle     time.Duration
+
+	// health check lifecycle
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
-// 創建新的反向代理伺服器
+// 創建新的反向代理伺服器. Health checks run once Start is called.
 func NewProxyServer(upstreamURLs []string) (*ProxyServer, error) {
+	return newProxyServer(upstreamURLs, nil)
+}
+
+// newProxyServer creates a proxy server, reusing the upstream servers in
+// existing whose URL is unchanged so health state and ActiveConns survive a
+// reload.
+func newProxyServer(upstreamURLs []string, existing map[string]*UpstreamServer) (*ProxyServer, error) {
 	servers := make([]*UpstreamServer, 0, len(upstreamURLs))
 
 	for _, rawURL := range upstreamURLs {
@@ -43,18 +169,18 @@ func NewProxyServer(upstreamURLs []string) (*ProxyServer, error) {
 			return nil, fmt.Errorf("invalid upstream URL %s: %v", rawURL, err)
 		}
 
-		proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
-		// 自定義錯誤處理
-		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-			log.Printf("代理錯誤: %v", err)
-			http.Error(w, "服務暫時不可用", http.StatusServiceUnavailable)
+		if server, ok := existing[upstreamURL.String()]; ok {
+			servers = append(servers, server)
+			continue
 		}
 
-		servers = append(servers, &UpstreamServer{
-			URL:          upstreamURL,
-			Alive:        true,
-			ReverseProxy: proxy,
-		})
+		proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+		// 自定義錯誤處理, retries and outlier detection are fed from here
+		proxy.ErrorHandler = handleProxyError
+		proxy.ModifyResponse = modifyResponse
+		proxy.Transport = attemptTransport{}
+
+		servers = append(servers, newUpstreamServer(upstreamURL, proxy))
 	}
 
 	lb := NewLoadBalancer(servers, RoundRobin)
@@ -66,67 +192,397 @@ func NewProxyServer(upstreamURLs []string) (*ProxyServer, error) {
 	// 設置默認配置
 	proxy.Config.HealthCheckInterval = 10 * time.Second
 	proxy.Config.MaxFailCount = 3
+	proxy.Config.RiseCount = 1
 	proxy.Config.Timeout = 5 * time.Second
 
-	// 啟動健康檢查
-	go proxy.healthCheck()
-
 	return proxy, nil
 }
 
-// 健康檢查
-func (p *ProxyServer) healthCheck() {
-	ticker := time.NewTicker(p.Config.HealthCheckInterval)
+// Start runs the health checks until ctx is done or Stop is called. Calling
+// it on a running proxy server does nothing.
+func (p *ProxyServer) Start(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cancel != nil {
+		return
+	}
+	ctx, p.cancel = context.WithCancel(ctx)
+
+	// health checks connect the way requests do
 	client := &http.Client{
 		Timeout: p.Config.Timeout,
 	}
+	if p.transport != nil {
+		client.Transport = p.transport
+	}
+
+	p.LoadBalancer.mu.RLock()
+	servers := p.LoadBalancer.servers
+	p.LoadBalancer.mu.RUnlock()
 
-	for range ticker.C {
-		p.LoadBalancer.mu.Lock()
-		for _, server := range p.LoadBalancer.servers {
-			go func(server *UpstreamServer) {
-				resp, err := client.Get(server.URL.String())
-				if err != nil {
-					server.FailCount++
-					if server.FailCount >= p.Config.MaxFailCount {
-						server.Alive = false
-					}
-					log.Printf("健康檢查失敗 %s: %v", server.URL, err)
-					return
-				}
-				defer resp.Body.Close()
-
-				if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-					server.Alive = true
-					server.FailCount = 0
-				} else {
-					server.FailCount++
-					if server.FailCount >= p.Config.MaxFailCount {
-						server.Alive = false
-					}
-				}
-				server.LastChecked = time.Now()
-			}(server)
-		}
-		p.LoadBalancer.mu.Unlock()
+	// 健康檢查, every server runs on its own schedule so down servers can be
+	// probed faster
+	for _, server := range servers {
+		p.wg.Add(1)
+		go func(server *UpstreamServer) {
+			defer p.wg.Done()
+			p.checkLoop(ctx, client, server)
+		}(server)
 	}
 }
 
-func (p *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	server := p.LoadBalancer.GetNextServer(r.RemoteAddr)
-	if server == nil {
-		http.Error(w, "No available upstream servers", http.StatusServiceUnavailable)
+// Stop stops the health checks and waits for them to exit. Requests already
+// being served are not interrupted.
+func (p *ProxyServer) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cancel == nil {
 		return
 	}
+	p.cancel()
+	p.wg.Wait()
+	p.cancel = nil
+
+	if p.transport != nil {
+		p.transport.CloseIdleConnections()
+	}
+}
+
+// upstreams returns the upstream servers keyed by URL
+func (p *ProxyServer) upstreams() map[string]*UpstreamServer {
+	p.LoadBalancer.mu.RLock()
+	defer p.LoadBalancer.mu.RUnlock()
+
+	servers := make(map[string]*UpstreamServer, len(p.LoadBalancer.servers))
+	for _, server := range p.LoadBalancer.servers {
+		servers[server.URL.String()] = server
+	}
+	return servers
+}
+
+// setWeight stages the weight of an upstream server for commitUpstreams
+func (p *ProxyServer) setWeight(serverURL string, weight int32) {
+	if p.weights == nil {
+		p.weights = make(map[string]int32)
+	}
+	p.weights[serverURL] = weight
+}
+
+// commitUpstreams writes the weights and connection limits of the route to
+// its upstream servers. Upstream servers reused from the previous config
+// are still serving it until the new handlers are swapped in, so this runs
+// only after that. Requests waiting in the queue of the previous config
+// move on to the new one.
+func (p *ProxyServer) commitUpstreams() {
+	p.LoadBalancer.mu.RLock()
+	defer p.LoadBalancer.mu.RUnlock()
+
+	for _, server := range p.LoadBalancer.servers {
+		if p.weights != nil {
+			atomic.StoreInt32(&server.Weight, p.weights[server.URL.String()])
+			atomic.StoreInt32(&server.CurrentWeight, 0)
+		}
+		atomic.StoreInt32(&server.MaxConns, p.maxConns)
+		if old := server.queue.Swap(p.queue); old != nil && old != p.queue {
+			old.moveTo(p.queue)
+		}
+	}
+}
+
+func (p *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.buffer != nil {
+		cleanup, err := p.buffer.buffer(r)
+		defer cleanup()
+		if errors.Is(err, errBodyTooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Reading request body failed", http.StatusBadRequest)
+			return
+		}
+	}
 
-	// Track active connections
-	p.LoadBalancer.strategyHandler.IncrementConnections(server)
-	defer p.LoadBalancer.strategyHandler.DecrementConnections(server)
+	if p.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeoutCause(r.Context(), p.requestTimeout, errRequestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	if p.retry != nil {
+		p.retry.budget.request()
+	}
+
+	var tried map[*UpstreamServer]bool
+	for n := 1; ; n++ {
+		server, probe, err := p.acquireServer(r, tried)
+		switch {
+		case errors.Is(err, errQueueFull), errors.Is(err, errQueueTimeout):
+			log.Printf("Request to %s rejected: %v", r.URL.Path, err)
+			http.Error(w, "服務暫時不可用", http.StatusServiceUnavailable)
+			return
+		case errors.Is(err, errNoServer):
+			http.Error(w, "No available upstream servers", http.StatusServiceUnavailable)
+			return
+		case err != nil && errors.Is(context.Cause(r.Context()), errRequestTimeout):
+			log.Printf("代理逾時 [%s]: waiting in queue", TimeoutRequest)
+			http.Error(w, "Upstream timed out", http.StatusGatewayTimeout)
+			return
+		case err != nil:
+			// the client went away while queued
+			return
+		}
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.upstream = server.URL.String()
+			info.retries = n - 1
+		}
 
-	// Add proxy headers
-	r.Header.Add("X-Forwarded-For", r.RemoteAddr)
-	r.Header.Add("X-Real-IP", r.RemoteAddr)
-	r.Header.Add("X-Proxy-Id", "go-reverse-engine")
+		at := &attempt{
+			cookie:     p.LoadBalancer.AffinityCookie(r, server),
+			streamIdle: p.streamIdle,
+			probe:      probe,
+			server:     server,
+			headers:    p.responseHeaders,
+		}
+		if p.transport != nil {
+			at.transport = p.transport
+		}
+		if p.retry != nil && n < p.retry.attempts && replayable(r) && p.retry.budget.available() {
+			at.policy = p.retry
+		}
+
+		p.serveAttempt(w, r, server, at)
+		if !at.retry {
+			return
+		}
+
+		// retry on another server after a jittered backoff
+		p.retry.budget.spend()
+		if tried == nil {
+			tried = make(map[*UpstreamServer]bool)
+		}
+		tried[server] = true
+		if r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				http.Error(w, "服務暫時不可用", http.StatusServiceUnavailable)
+				return
+			}
+			r.Body = body
+		}
+
+		timer := time.NewTimer(p.retry.backoffFor(n))
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			if errors.Is(context.Cause(r.Context()), errRequestTimeout) {
+				log.Printf("代理逾時 [%s]: %v", TimeoutRequest, at.err)
+				http.Error(w, "Upstream timed out", http.StatusGatewayTimeout)
+			}
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// nextServer picks the server for the next attempt, skipping servers whose
+// half-open circuit has no probe left
+func (p *ProxyServer) nextServer(r *http.Request, tried map[*UpstreamServer]bool) (*UpstreamServer, bool) {
+	for {
+		server := p.LoadBalancer.getNextServer(r, tried)
+		if server == nil || p.breaker == nil {
+			return server, false
+		}
+		if probe, ok := p.breaker.allow(server); ok {
+			return server, probe
+		}
+		if tried[server] {
+			return nil, false
+		}
+
+		skipped := map[*UpstreamServer]bool{server: true}
+		for s := range tried {
+			skipped[s] = true
+		}
+		tried = skipped
+	}
+}
+
+// acquireServer picks the server for the next attempt and takes one of its
+// connections. While every healthy server is at max_conns the request waits
+// in the queue.
+func (p *ProxyServer) acquireServer(r *http.Request, tried map[*UpstreamServer]bool) (*UpstreamServer, bool, error) {
+	var deadline time.Time
+	for {
+		// a connection released from here on is not missed by the wait
+		queue := p.queue.current()
+		var gen uint64
+		if queue != nil {
+			gen = queue.generation()
+		}
+
+		server, probe := p.nextServer(r, tried)
+		if server != nil {
+			if server.acquireConn() {
+				return server, probe, nil
+			}
+			// another request took the last connection
+			if p.breaker != nil {
+				p.breaker.record(server, probe, false, 0, true)
+			}
+		}
+
+		if queue == nil || !p.LoadBalancer.hasHealthyServers() {
+			return nil, false, errNoServer
+		}
+		requeue := !deadline.IsZero()
+		if !requeue {
+			deadline = time.Now().Add(queue.timeout)
+		}
+		if err := queue.wait(r.Context(), deadline, requeue, gen); err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// serveAttempt proxies the request to server once, releasing the
+// connection taken by acquireServer when done
+func (p *ProxyServer) serveAttempt(w http.ResponseWriter, r *http.Request, server *UpstreamServer, at *attempt) {
+	defer server.releaseConn()
+
+	ctx, cancel := context.WithCancel(context.WithValue(r.Context(), attemptKey{}, at))
+	defer cancel()
+	at.cancel = cancel
+	at.start = time.Now()
+	if p.retry != nil {
+		at.startTimer(p.retry.perTryTimeout, cancel)
+		defer at.stopTimer()
+	}
+
+	// the rules run on a copy so retries start from the original headers
+	if len(p.requestHeaders) > 0 {
+		out := r.Clone(ctx)
+		vars := headerVariables(out, server)
+		for _, rules := range p.requestHeaders {
+			rules.apply(out.Header, vars)
+		}
+		server.ReverseProxy.ServeHTTP(w, out)
+	} else {
+		server.ReverseProxy.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	// a client that went away says nothing about the upstream, unlike the
+	// request timeout
+	cancelled := r.Context().Err() != nil && !errors.Is(context.Cause(r.Context()), errRequestTimeout)
+
+	if p.breaker != nil {
+		p.breaker.record(server, at.probe, at.failed(), at.latency, cancelled)
+	}
+
+	if p.outlier != nil && !cancelled {
+		p.LoadBalancer.mu.RLock()
+		servers := p.LoadBalancer.servers
+		p.LoadBalancer.mu.RUnlock()
+		p.outlier.record(server, servers, at.failed())
+	}
+}
+
+// SetBuffer turns on request body buffering so bodies can be replayed
+func (p *ProxyServer) SetBuffer(cfg BufferConfig) error {
+	buffer, err := newBodyBuffer(cfg)
+	if err != nil {
+		return err
+	}
+	p.buffer = buffer
+	return nil
+}
+
+// SetHeaders sets the request and response header rules, nil rules are
+// skipped
+func (p *ProxyServer) SetHeaders(request, response []*HeaderRules) error {
+	var err error
+	if p.requestHeaders, err = compileHeaderRuleList(request); err != nil {
+		return err
+	}
+	p.responseHeaders, err = compileHeaderRuleList(response)
+	return err
+}
+
+func compileHeaderRuleList(list []*HeaderRules) ([]*headerRules, error) {
+	var compiled []*headerRules
+	for _, cfg := range list {
+		if cfg == nil {
+			continue
+		}
+		rules, err := compileHeaderRules(*cfg)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, rules)
+	}
+	return compiled, nil
+}
+
+// SetUpstreamTLS sets how the proxy server connects to https upstreams
+func (p *ProxyServer) SetUpstreamTLS(cfg UpstreamTLSConfig) error {
+	config, err := newUpstreamTLS(cfg)
+	if err != nil {
+		return err
+	}
+	p.routeTransport().TLSClientConfig = config
+	return nil
+}
+
+// routeTransport returns the transport of the route, a copy of the default
+// transport created on first use
+func (p *ProxyServer) routeTransport() *http.Transport {
+	if p.transport == nil {
+		p.transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	return p.transport
+}
+
+// SetTimeouts sets the upstream timeouts of the proxy server
+func (p *ProxyServer) SetTimeouts(cfg RouteTimeouts) {
+	applyTimeouts(p.routeTransport(), cfg)
+	p.requestTimeout = cfg.Request
+	p.streamIdle = cfg.StreamIdle
+}
+
+// SetRetry sets the retry policy of the proxy server
+func (p *ProxyServer) SetRetry(cfg RetryConfig) error {
+	retry, err := compileRetryPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	p.retry = retry
+	return nil
+}
+
+// SetMaxConns caps the concurrent requests of every upstream server. With a
+// queue, requests wait for a free connection instead of getting a 503.
+func (p *ProxyServer) SetMaxConns(maxConns int, queue *QueueConfig) {
+	p.setMaxConns(maxConns, queue)
+	p.commitUpstreams()
+}
+
+// setMaxConns stages the connection limit for commitUpstreams
+func (p *ProxyServer) setMaxConns(maxConns int, queue *QueueConfig) {
+	p.maxConns = int32(maxConns)
+	p.queue = nil
+	if queue != nil {
+		p.queue = newConnQueue(*queue)
+	}
+}
+
+// SetCircuitBreaker turns on the circuit breaker of every upstream server
+func (p *ProxyServer) SetCircuitBreaker(cfg CircuitBreakerConfig) {
+	p.breaker = newCircuitBreaker(cfg)
+}
 
-	server.ReverseProxy.ServeHTTP(w, r)
+// SetOutlierDetection turns on passive health checking from proxied traffic
+func (p *ProxyServer) SetOutlierDetection(cfg OutlierConfig) {
+	p.outlier = newOutlierDetector(cfg)
 }
@@ -1,8 +1,10 @@
 package proxy
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -68,15 +70,189 @@ func TestProxyServer_healthCheck(t *testing.T) {
 	proxyServer.Config.Timeout = 100 * time.Millisecond
 	proxyServer.Config.MaxFailCount = 1
 
-	// Simulate running the health check by calling it directly
-	go proxyServer.healthCheck()
+	// Start the health check and stop it when the test ends
+	proxyServer.Start(context.Background())
+	defer proxyServer.Stop()
 
 	// Wait for health check to complete
 	time.Sleep(500 * time.Millisecond)
 
 	// Check if the server is marked as down
 	server := proxyServer.LoadBalancer.servers[0]
-	if server.Alive {
+	if server.IsAlive() {
 		t.Errorf("Expected server to be marked as down, but it is alive")
 	}
 }
+
+func TestProxyServer_StartStop(t *testing.T) {
+	var checks atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	proxyServer, err := NewProxyServer([]string{upstream.URL})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	proxyServer.Config.HealthCheckInterval = 10 * time.Millisecond
+
+	// nothing runs before Start
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), checks.Load(), "Expected no health check before Start")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proxyServer.Start(ctx)
+	time.Sleep(50 * time.Millisecond)
+	assert.Greater(t, checks.Load(), int32(0), "Expected health checks after Start")
+	assert.False(t, proxyServer.LoadBalancer.servers[0].LastChecked().IsZero())
+
+	// cancelling the context ends the checks, Stop waits for them
+	cancel()
+	proxyServer.Stop()
+	stopped := checks.Load()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, stopped, checks.Load(), "Expected no health check after Stop")
+
+	// a stopped proxy server can be started again
+	proxyServer.Start(context.Background())
+	proxyServer.Stop()
+}
+
+func TestProxyServer_OutlierDetection(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	proxyServer, err := NewProxyServer([]string{failing.URL, healthy.URL})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer proxyServer.Stop()
+	proxyServer.SetOutlierDetection(OutlierConfig{ConsecutiveErrors: 2, BaseEjectionTime: time.Minute})
+
+	// round robin alternates until the failing server is ejected
+	for i := 0; i < 4; i++ {
+		proxyServer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost", nil))
+	}
+
+	bad := proxyServer.LoadBalancer.servers[0]
+	assert.True(t, bad.Ejected(), "Expected failing server to be ejected")
+	assert.True(t, bad.IsAlive(), "Expected passive ejection to leave active health state alone")
+
+	for i := 0; i < 4; i++ {
+		rr := httptest.NewRecorder()
+		proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	// the ejection grows on the next ejection
+	bad.ejectedUntil.Store(0)
+	for i := 0; i < 4; i++ {
+		proxyServer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost", nil))
+	}
+	assert.Greater(t, time.Until(time.Unix(0, bad.ejectedUntil.Load())), time.Minute+30*time.Second)
+}
+
+func TestProxyServer_OutlierDetectionKeepsPool(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	proxyServer, err := NewProxyServer([]string{failing.URL, failing.URL + "/"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer proxyServer.Stop()
+	proxyServer.SetOutlierDetection(OutlierConfig{ConsecutiveErrors: 1, MaxEjectionPercent: 100})
+
+	for i := 0; i < 10; i++ {
+		proxyServer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost", nil))
+	}
+
+	ejected := 0
+	for _, server := range proxyServer.LoadBalancer.servers {
+		if server.Ejected() {
+			ejected++
+		}
+	}
+	assert.Equal(t, 1, ejected, "Expected passive checks to never eject the whole pool")
+}
+
+func TestProxyServer_configuredHealthCheck(t *testing.T) {
+	healthy := true
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" || r.Method != http.MethodHead && r.Method != http.MethodGet || r.Host != "internal.example.com" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		w.Write([]byte("status: ready"))
+	}))
+	defer upstream.Close()
+
+	proxyServer, err := newProxyServer([]string{upstream.URL}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	err = proxyServer.SetHealthCheck(HealthCheckConfig{
+		Path:           "/ready",
+		Headers:        map[string]string{"Host": "internal.example.com"},
+		ExpectedStatus: []string{"200-204"},
+		Rise:           2,
+		Fall:           2,
+	})
+	assert.NoError(t, err)
+
+	client := &http.Client{Timeout: time.Second}
+	server := proxyServer.LoadBalancer.servers[0]
+
+	healthy = false
+	proxyServer.checkServer(context.Background(), client, server)
+	assert.True(t, server.IsAlive(), "Expected one failure to stay below the fall threshold")
+	proxyServer.checkServer(context.Background(), client, server)
+	assert.False(t, server.IsAlive(), "Expected server to be marked down after two failures")
+
+	healthy = true
+	proxyServer.checkServer(context.Background(), client, server)
+	assert.False(t, server.IsAlive(), "Expected one success to stay below the rise threshold")
+	proxyServer.checkServer(context.Background(), client, server)
+	assert.True(t, server.IsAlive(), "Expected server to be marked up after two successes")
+
+	// the body has to match when configured
+	err = proxyServer.SetHealthCheck(HealthCheckConfig{
+		Path:      "/ready",
+		Headers:   map[string]string{"Host": "internal.example.com"},
+		BodyRegex: "status: (ok|up)",
+		Fall:      1,
+	})
+	assert.NoError(t, err)
+	proxyServer.checkServer(context.Background(), client, server)
+	assert.False(t, server.IsAlive(), "Expected body mismatch to fail the check")
+}
+
+func TestCompileHealthProbe(t *testing.T) {
+	probe, err := compileHealthProbe(HealthCheckConfig{ExpectedStatus: []string{"200", "300-399"}})
+	assert.NoError(t, err)
+	assert.True(t, probe.statusExpected(200))
+	assert.True(t, probe.statusExpected(302))
+	assert.False(t, probe.statusExpected(204))
+
+	_, err = compileHealthProbe(HealthCheckConfig{ExpectedStatus: []string{"399-300"}})
+	assert.Error(t, err)
+
+	_, err = compileHealthProbe(HealthCheckConfig{BodyRegex: "("})
+	assert.Error(t, err)
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default time a request may wait in the queue
+const defaultQueueTimeout = 10 * time.Second
+
+var (
+	errNoServer     = errors.New("no available upstream servers")
+	errQueueFull    = errors.New("upstream queue full")
+	errQueueTimeout = errors.New("upstream queue timeout")
+)
+
+// acquireConn takes one of the server's connections, failing when it is at
+// MaxConns. ActiveConns is the only count of connections in use.
+func (s *UpstreamServer) acquireConn() bool {
+	for {
+		active := atomic.LoadInt32(&s.ActiveConns)
+		if max := atomic.LoadInt32(&s.MaxConns); max > 0 && active >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.ActiveConns, active, active+1) {
+			return true
+		}
+	}
+}
+
+// releaseConn gives back a connection and wakes the next queued request
+func (s *UpstreamServer) releaseConn() {
+	atomic.AddInt32(&s.ActiveConns, -1)
+	if q := s.queue.Load(); q != nil {
+		q.signal()
+	}
+}
+
+// hasCapacity reports whether the server is below MaxConns
+func (s *UpstreamServer) hasCapacity() bool {
+	max := atomic.LoadInt32(&s.MaxConns)
+	return max <= 0 || atomic.LoadInt32(&s.ActiveConns) < max
+}
+
+// connQueue holds requests waiting for an upstream connection, first come
+// first served
+type connQueue struct {
+	size    int
+	timeout time.Duration
+
+	mu      sync.Mutex
+	waiters *list.List // of chan struct{}
+	gen     uint64     // bumped on every release, so a wait can tell it missed one
+	moved   bool       // replaced by next on reload
+	next    *connQueue
+}
+
+func newConnQueue(cfg QueueConfig) *connQueue {
+	q := &connQueue{
+		size:    cfg.Size,
+		timeout: cfg.Timeout,
+		waiters: list.New(),
+	}
+	if q.timeout <= 0 {
+		q.timeout = defaultQueueTimeout
+	}
+	return q
+}
+
+// generation returns the count of releases, taken before looking for a
+// server and handed to wait
+func (q *connQueue) generation() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.gen
+}
+
+// current returns the queue requests should wait in, following the queues
+// that replaced q. It is nil when the config has no queue anymore.
+func (q *connQueue) current() *connQueue {
+	for q != nil {
+		q.mu.Lock()
+		moved, next := q.moved, q.next
+		q.mu.Unlock()
+		if !moved {
+			return q
+		}
+		q = next
+	}
+	return nil
+}
+
+// wait blocks until a connection is released, deadline passes or ctx is
+// done. It returns right away when a connection was released since gen was
+// taken, or the queue was replaced. A request that was woken before and lost
+// the connection to another one waits at the front again.
+func (q *connQueue) wait(ctx context.Context, deadline time.Time, front bool, gen uint64) error {
+	ready := make(chan struct{}, 1)
+
+	q.mu.Lock()
+	if q.gen != gen || q.moved {
+		q.mu.Unlock()
+		return nil
+	}
+	if q.waiters.Len() >= q.size && !front {
+		q.mu.Unlock()
+		return errQueueFull
+	}
+	var el *list.Element
+	if front {
+		el = q.waiters.PushFront(ready)
+	} else {
+		el = q.waiters.PushBack(ready)
+	}
+	q.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-ready:
+		// woken while giving up, pass the connection on
+		q.signalLocked()
+	default:
+		q.waiters.Remove(el)
+	}
+	return err
+}
+
+// signal wakes the request waiting the longest
+func (q *connQueue) signal() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.signalLocked()
+}
+
+func (q *connQueue) signalLocked() {
+	q.gen++
+	if front := q.waiters.Front(); front != nil {
+		q.waiters.Remove(front)
+		front.Value.(chan struct{}) <- struct{}{}
+	}
+}
+
+// moveTo replaces the queue with next, the queue of the new config, and
+// wakes every waiting request to look for a server again
+func (q *connQueue) moveTo(next *connQueue) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.moved = true
+	q.next = next
+	for q.waiters.Len() > 0 {
+		q.signalLocked()
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newBlockingUpstream returns an upstream that holds every request until
+// release is closed
+func newBlockingUpstream(t *testing.T) (*httptest.Server, chan struct{}, *atomic.Int32) {
+	release := make(chan struct{})
+	var arrived atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Add(1)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, release, &arrived
+}
+
+func serveAsync(proxyServer *ProxyServer) <-chan int {
+	code := make(chan int, 1)
+	go func() {
+		rr := httptest.NewRecorder()
+		proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+		code <- rr.Code
+	}()
+	return code
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProxyServer_MaxConnsQueue(t *testing.T) {
+	upstream, release, arrived := newBlockingUpstream(t)
+
+	proxyServer, err := NewProxyServer([]string{upstream.URL})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	proxyServer.SetMaxConns(1, &QueueConfig{Size: 1, Timeout: time.Second})
+	server := proxyServer.LoadBalancer.servers[0]
+
+	first := serveAsync(proxyServer)
+	waitFor(t, func() bool { return arrived.Load() == 1 })
+
+	queued := serveAsync(proxyServer)
+	waitFor(t, func() bool {
+		proxyServer.queue.mu.Lock()
+		defer proxyServer.queue.mu.Unlock()
+		return proxyServer.queue.waiters.Len() == 1
+	})
+
+	// the queue is full
+	rr := httptest.NewRecorder()
+	proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&server.ActiveConns), "Expected max_conns to hold")
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-first)
+	assert.Equal(t, http.StatusOK, <-queued)
+	assert.Equal(t, int32(2), arrived.Load())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&server.ActiveConns))
+}
+
+func TestProxyServer_MaxConnsQueueTimeout(t *testing.T) {
+	upstream, release, arrived := newBlockingUpstream(t)
+	defer close(release)
+
+	proxyServer, err := NewProxyServer([]string{upstream.URL})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// without a queue the request is rejected right away
+	proxyServer.SetMaxConns(1, nil)
+	serveAsync(proxyServer)
+	waitFor(t, func() bool { return arrived.Load() == 1 })
+
+	rr := httptest.NewRecorder()
+	proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	proxyServer.SetMaxConns(1, &QueueConfig{Size: 10, Timeout: 50 * time.Millisecond})
+	start := time.Now()
+	rr = httptest.NewRecorder()
+	proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestProxyServer_MaxConnsSpillsOver(t *testing.T) {
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer busy.Close()
+	idle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer idle.Close()
+
+	for _, strategy := range []Strategy{RoundRobin, LeastConnections, ConsistentHash} {
+		proxyServer, err := NewProxyServer([]string{busy.URL, idle.URL})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		proxyServer.LoadBalancer.UpdateStrategy(strategy)
+		proxyServer.SetMaxConns(1, nil)
+
+		// the busy server is at max_conns, everything goes to the idle one
+		busyServer := proxyServer.LoadBalancer.servers[0]
+		assert.True(t, busyServer.acquireConn())
+		assert.False(t, busyServer.acquireConn())
+		for i := 0; i < 5; i++ {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "http://localhost", nil)
+			r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i)
+			proxyServer.ServeHTTP(rr, r)
+			assert.Equal(t, http.StatusOK, rr.Code, "strategy %s", strategy)
+		}
+		busyServer.releaseConn()
+	}
+}
+
+func TestConnQueue_FIFO(t *testing.T) {
+	q := newConnQueue(QueueConfig{Size: 3})
+	deadline := time.Now().Add(time.Second)
+
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			if q.wait(context.Background(), deadline, false, 0) == nil {
+				order <- i
+			}
+		}(i)
+		waitFor(t, func() bool {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return q.waiters.Len() == i+1
+		})
+	}
+
+	assert.Equal(t, errQueueFull, q.wait(context.Background(), deadline, false, 0))
+
+	for i := 0; i < 3; i++ {
+		q.signal()
+		assert.Equal(t, i, <-order)
+	}
+}
+
+func TestConnQueue_MissedSignal(t *testing.T) {
+	q := newConnQueue(QueueConfig{Size: 1})
+	gen := q.generation()
+
+	// released between looking for a server and starting to wait
+	q.signal()
+
+	start := time.Now()
+	assert.NoError(t, q.wait(context.Background(), time.Now().Add(time.Second), false, gen))
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "Expected the wait not to miss the release")
+}
+
+func TestConnQueue_MoveTo(t *testing.T) {
+	old := newConnQueue(QueueConfig{Size: 1})
+	next := newConnQueue(QueueConfig{Size: 1})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- old.wait(context.Background(), time.Now().Add(time.Second), false, old.generation())
+	}()
+	waitFor(t, func() bool {
+		old.mu.Lock()
+		defer old.mu.Unlock()
+		return old.waiters.Len() == 1
+	})
+
+	old.moveTo(next)
+	assert.NoError(t, <-done, "Expected waiters woken when the queue is replaced")
+	assert.Same(t, next, old.current())
+
+	next.moveTo(nil)
+	assert.Nil(t, old.current(), "Expected no queue once the config drops it")
+}
@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"container/list"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limit algorithms
+const (
+	TokenBucket   = "token-bucket"
+	SlidingWindow = "sliding-window"
+)
+
+// Rate limit key sources
+const (
+	RateLimitKeyIP     = "ip"
+	RateLimitKeyHeader = "header"
+	RateLimitKeyJWT    = "jwt"
+	RateLimitKeyPath   = "path"
+)
+
+// Defaults for rate limits when the config leaves a field empty
+const (
+	defaultRateLimitPeriod  = time.Second
+	defaultRateLimitMaxKeys = 10000
+)
+
+// rateLimiter limits requests per key. Keys are kept in an LRU list, the
+// key idle the longest is dropped when there are more than maxKeys.
+type rateLimiter struct {
+	cfg       RateLimitConfig // as configured, to reuse the limiter on reload
+	algorithm string
+	requests  int
+	period    time.Duration
+	burst     int
+	keySource string
+	keyName   string
+	maxKeys   int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// limiterEntry is the state of one key
+type limiterEntry struct {
+	key string
+
+	// token bucket
+	tokens float64
+	last   time.Time
+
+	// sliding window, weighted over the current and the previous window
+	window    int64
+	count     int
+	prevCount int
+}
+
+// reuseRateLimiter returns previous when it was built from cfg, so its keys
+// keep their state across reloads, and a new limiter otherwise
+func reuseRateLimiter(previous *rateLimiter, cfg RateLimitConfig) (*rateLimiter, error) {
+	if previous != nil && previous.cfg == cfg {
+		return previous, nil
+	}
+	return newRateLimiter(cfg)
+}
+
+func newRateLimiter(cfg RateLimitConfig) (*rateLimiter, error) {
+	l := &rateLimiter{
+		cfg:       cfg,
+		algorithm: cfg.Algorithm,
+		requests:  cfg.Requests,
+		period:    cfg.Period,
+		burst:     cfg.Burst,
+		keySource: cfg.Key,
+		keyName:   cfg.Name,
+		maxKeys:   cfg.MaxKeys,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+
+	if l.requests <= 0 {
+		return nil, fmt.Errorf("rate limit requests must be at least 1")
+	}
+	if l.algorithm == "" {
+		l.algorithm = TokenBucket
+	}
+	if l.algorithm != TokenBucket && l.algorithm != SlidingWindow {
+		return nil, fmt.Errorf("unknown rate limit algorithm %q", l.algorithm)
+	}
+	if l.period <= 0 {
+		l.period = defaultRateLimitPeriod
+	}
+	if l.burst <= 0 {
+		l.burst = l.requests
+	}
+	if l.maxKeys <= 0 {
+		l.maxKeys = defaultRateLimitMaxKeys
+	}
+
+	switch l.keySource {
+	case "":
+		l.keySource = RateLimitKeyIP
+	case RateLimitKeyIP, RateLimitKeyPath:
+	case RateLimitKeyHeader, RateLimitKeyJWT:
+		if l.keyName == "" {
+			return nil, fmt.Errorf("rate limit key %s needs a name", l.keySource)
+		}
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %q", l.keySource)
+	}
+
+	return l, nil
+}
+
+// allow takes one request from the client's quota and sets the RateLimit
+// headers. A rejected request gets a 429 and allow returns false.
+func (l *rateLimiter) allow(w http.ResponseWriter, r *http.Request) bool {
+	ok, remaining, reset := l.take(l.key(r), time.Now())
+
+	limit := l.requests
+	if l.algorithm == TokenBucket {
+		limit = l.burst
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(reset)))
+
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds(reset)))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+// take counts one request for key. It returns whether the request is
+// allowed, how many are left and how long until the quota frees up.
+func (l *rateLimiter) take(key string, now time.Time) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var entry *limiterEntry
+	if el, ok := l.entries[key]; ok {
+		l.lru.MoveToFront(el)
+		entry = el.Value.(*limiterEntry)
+	} else {
+		entry = &limiterEntry{key: key, tokens: float64(l.burst), last: now}
+		l.entries[key] = l.lru.PushFront(entry)
+		if l.lru.Len() > l.maxKeys {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.entries, oldest.Value.(*limiterEntry).key)
+		}
+	}
+
+	if l.algorithm == SlidingWindow {
+		return l.takeWindow(entry, now)
+	}
+	return l.takeToken(entry, now)
+}
+
+func (l *rateLimiter) takeToken(entry *limiterEntry, now time.Time) (bool, int, time.Duration) {
+	perToken := l.period / time.Duration(l.requests)
+
+	entry.tokens += float64(now.Sub(entry.last)) / float64(perToken)
+	if entry.tokens > float64(l.burst) {
+		entry.tokens = float64(l.burst)
+	}
+	entry.last = now
+
+	if entry.tokens < 1 {
+		return false, 0, time.Duration((1 - entry.tokens) * float64(perToken))
+	}
+	entry.tokens--
+	return true, int(entry.tokens), time.Duration((float64(l.burst) - entry.tokens) * float64(perToken))
+}
+
+func (l *rateLimiter) takeWindow(entry *limiterEntry, now time.Time) (bool, int, time.Duration) {
+	window := now.UnixNano() / int64(l.period)
+	switch window - entry.window {
+	case 0:
+	case 1:
+		entry.prevCount, entry.count = entry.count, 0
+	default:
+		entry.prevCount, entry.count = 0, 0
+	}
+	entry.window = window
+
+	elapsed := time.Duration(now.UnixNano() - window*int64(l.period))
+	weight := 1 - float64(elapsed)/float64(l.period)
+	estimate := int(math.Floor(float64(entry.prevCount)*weight)) + entry.count
+	reset := l.period - elapsed
+
+	if estimate >= l.requests {
+		return false, 0, reset
+	}
+	entry.count++
+	return true, l.requests - estimate - 1, reset
+}
+
+// key returns what the request is limited by. Header and JWT keys fall back
+// to the client IP when missing.
+func (l *rateLimiter) key(r *http.Request) string {
+	switch l.keySource {
+	case RateLimitKeyHeader:
+		if v := r.Header.Get(l.keyName); v != "" {
+			return v
+		}
+	case RateLimitKeyJWT:
+		if v := jwtClaim(r, l.keyName); v != "" {
+			return v
+		}
+	case RateLimitKeyPath:
+		return r.URL.Path
+	}
+	return clientIP(r)
+}
+
+// jwtClaim reads a claim from the bearer token without verifying it, so it
+// is only fit as a key when the token is verified in front of the proxy
+func jwtClaim(r *http.Request, claim string) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	if v, ok := claims[claim]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// seconds rounds d up to whole seconds, at least 1
+func seconds(d time.Duration) int {
+	s := int(math.Ceil(d.Seconds()))
+	if s < 1 {
+		return 1
+	}
+	return s
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLimiter(t *testing.T, cfg RateLimitConfig) *rateLimiter {
+	limiter, err := newRateLimiter(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return limiter
+}
+
+func TestRateLimiter_TokenBucket(t *testing.T) {
+	limiter := newTestLimiter(t, RateLimitConfig{Requests: 2, Period: time.Second, Burst: 3})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		ok, remaining, _ := limiter.take("client", now)
+		assert.True(t, ok)
+		assert.Equal(t, 2-i, remaining)
+	}
+	ok, _, retryAfter := limiter.take("client", now)
+	assert.False(t, ok, "Expected the burst to be used up")
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	// other keys have their own bucket
+	ok, _, _ = limiter.take("other", now)
+	assert.True(t, ok)
+
+	// tokens refill at requests per period
+	ok, _, _ = limiter.take("client", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+	ok, _, _ = limiter.take("client", now.Add(500*time.Millisecond))
+	assert.False(t, ok)
+}
+
+func TestRateLimiter_SlidingWindow(t *testing.T) {
+	limiter := newTestLimiter(t, RateLimitConfig{Algorithm: SlidingWindow, Requests: 4, Period: time.Minute})
+	start := time.Unix(0, 0).Add(time.Hour)
+
+	for i := 0; i < 4; i++ {
+		ok, _, _ := limiter.take("client", start)
+		assert.True(t, ok)
+	}
+	ok, _, reset := limiter.take("client", start.Add(30*time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, 30*time.Second, reset)
+
+	// a quarter into the next window three quarters of the last one still count
+	ok, remaining, _ := limiter.take("client", start.Add(75*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, 0, remaining)
+	ok, _, _ = limiter.take("client", start.Add(75*time.Second))
+	assert.False(t, ok)
+}
+
+func TestRateLimiter_EvictsIdleKeys(t *testing.T) {
+	limiter := newTestLimiter(t, RateLimitConfig{Requests: 1, Period: time.Hour, MaxKeys: 2})
+	now := time.Now()
+
+	limiter.take("a", now)
+	limiter.take("b", now)
+	limiter.take("a", now)
+	limiter.take("c", now)
+
+	assert.Len(t, limiter.entries, 2)
+	assert.Contains(t, limiter.entries, "a")
+	assert.NotContains(t, limiter.entries, "b", "Expected the idle key to be evicted")
+}
+
+func TestRateLimiter_Key(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-1","tier":3}`))
+	token := "Bearer header." + payload + ".signature"
+
+	tests := []struct {
+		name   string
+		cfg    RateLimitConfig
+		header http.Header
+		want   string
+	}{
+		{name: "ip without port", cfg: RateLimitConfig{}, want: "192.0.2.1"},
+		{name: "header", cfg: RateLimitConfig{Key: RateLimitKeyHeader, Name: "X-Api-Key"}, header: http.Header{"X-Api-Key": {"secret"}}, want: "secret"},
+		{name: "missing header", cfg: RateLimitConfig{Key: RateLimitKeyHeader, Name: "X-Api-Key"}, want: "192.0.2.1"},
+		{name: "jwt claim", cfg: RateLimitConfig{Key: RateLimitKeyJWT, Name: "sub"}, header: http.Header{"Authorization": {token}}, want: "user-1"},
+		{name: "jwt number claim", cfg: RateLimitConfig{Key: RateLimitKeyJWT, Name: "tier"}, header: http.Header{"Authorization": {token}}, want: "3"},
+		{name: "malformed jwt", cfg: RateLimitConfig{Key: RateLimitKeyJWT, Name: "sub"}, header: http.Header{"Authorization": {"Bearer nope"}}, want: "192.0.2.1"},
+		{name: "path", cfg: RateLimitConfig{Key: RateLimitKeyPath}, want: "/api/items"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Requests = 1
+			limiter := newTestLimiter(t, tt.cfg)
+			r := httptest.NewRequest("GET", "http://localhost/api/items?page=2", nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			assert.Equal(t, tt.want, limiter.key(r))
+		})
+	}
+}
+
+func TestRateLimiter_Allow(t *testing.T) {
+	limiter := newTestLimiter(t, RateLimitConfig{Requests: 1, Period: 10 * time.Second})
+
+	rr := httptest.NewRecorder()
+	assert.True(t, limiter.allow(rr, httptest.NewRequest("GET", "http://localhost", nil)))
+	assert.Equal(t, "1", rr.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", rr.Header().Get("RateLimit-Remaining"))
+
+	rr = httptest.NewRecorder()
+	assert.False(t, limiter.allow(rr, httptest.NewRequest("GET", "http://localhost", nil)))
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "10", rr.Header().Get("Retry-After"))
+	assert.Equal(t, "10", rr.Header().Get("RateLimit-Reset"))
+}
+
+func TestNewRateLimiter_Invalid(t *testing.T) {
+	for _, cfg := range []RateLimitConfig{
+		{},
+		{Requests: 1, Algorithm: "leaky-bucket"},
+		{Requests: 1, Key: RateLimitKeyHeader},
+		{Requests: 1, Key: "cookie"},
+	} {
+		_, err := newRateLimiter(cfg)
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
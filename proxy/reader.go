@@ -1,40 +1,354 @@
 package proxy
 
 import (
+	"fmt"
+	"net/url"
 	"os"
+	"reflect"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config struct to hold the settings from settings.yaml
 type Config struct {
-	Servers []ServerConfig `yaml:"servers"`
+	Servers    []ServerConfig    `yaml:"servers"`
+	Admin      *AdminConfig      `yaml:"admin,omitempty"`
+	AccessLog  *AccessLogConfig  `yaml:"access_log,omitempty"`
+	Forwarding *ForwardingConfig `yaml:"forwarding,omitempty"`
+	ACME       *ACMEConfig       `yaml:"acme,omitempty"`
+
+	HTTPRedirect *HTTPRedirectConfig `yaml:"http_redirect,omitempty"` // plain HTTP requests for TLS servers go to HTTPS
+}
+
+// HTTPRedirectConfig redirects plain HTTP requests for the names of TLS
+// servers to the HTTPS listener serving them. It shares the listener of the
+// ACME HTTP-01 challenges.
+type HTTPRedirectConfig struct {
+	Listen string `yaml:"listen,omitempty"` // the acme challenge_listen, :80 by default
+	Code   int    `yaml:"code,omitempty"`   // 301, 302, 303, 307 or 308 (default)
+}
+
+// ACMEConfig sets up how autocert gets certificates for the names without
+// a static certificate
+type ACMEConfig struct {
+	DirectoryURL    string        `yaml:"directory_url,omitempty"`    // Let's Encrypt production when empty
+	Staging         bool          `yaml:"staging,omitempty"`          // use the Let's Encrypt staging directory
+	Email           string        `yaml:"email,omitempty"`            // account contact
+	CacheDir        string        `yaml:"cache_dir,omitempty"`        // default ./certs
+	RenewBefore     time.Duration `yaml:"renew_before,omitempty"`     // default 720h
+	CAFile          string        `yaml:"ca_file,omitempty"`          // CAs trusted for the directory, like a local test CA
+	EAB             *EABConfig    `yaml:"eab,omitempty"`              // external account binding, required by some CAs
+	HTTPChallenge   *bool         `yaml:"http_challenge,omitempty"`   // answer HTTP-01 challenges, default true
+	ChallengeListen string        `yaml:"challenge_listen,omitempty"` // default :80
+}
+
+// EABConfig binds the ACME account to an existing account at the CA
+type EABConfig struct {
+	KeyID   string `yaml:"key_id"`
+	HMACKey string `yaml:"hmac_key"` // base64url, as handed out by the CA
+}
+
+// ForwardingConfig controls the forwarding headers sent upstream. Without
+// trusted proxies the peer address is the client and incoming forwarding
+// headers are dropped.
+type ForwardingConfig struct {
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"` // CIDRs or IPs whose forwarding headers are honored
+	Forwarded      bool     `yaml:"forwarded,omitempty"`       // also send the RFC 7239 Forwarded header
+}
+
+// AccessLogConfig writes one line per request
+type AccessLogConfig struct {
+	Format     string        `yaml:"format,omitempty"`      // common, combined (default), json or template
+	Template   string        `yaml:"template,omitempty"`    // text/template over the entry fields
+	Output     string        `yaml:"output,omitempty"`      // stdout (default), stderr or a file path
+	MaxSize    int           `yaml:"max_size,omitempty"`    // MB before the file is rotated
+	MaxAge     time.Duration `yaml:"max_age,omitempty"`     // how often the file is rotated
+	MaxBackups int           `yaml:"max_backups,omitempty"` // rotated files kept, all when empty
+	Sample     float64       `yaml:"sample,omitempty"`      // share of requests logged, 5xx always are
+}
+
+// AdminConfig is the listener serving the proxy's own endpoints
+type AdminConfig struct {
+	Listen      string `yaml:"listen"`
+	MetricsPath string `yaml:"metrics_path,omitempty"` // default /metrics
+}
+
+// metricsPath returns where metrics are served
+func (admin *AdminConfig) metricsPath() string {
+	if admin.MetricsPath == "" {
+		return "/metrics"
+	}
+	return admin.MetricsPath
 }
 
 type ServerConfig struct {
-	Listen string        `yaml:"listen"`
-	Ssl    bool          `yaml:"ssl"`
-	Host   string        `yaml:"host"`
-	Routes []RouteConfig `yaml:"routes"`
+	Listen  string        `yaml:"listen"`
+	Ssl     bool          `yaml:"ssl"`
+	Host    string        `yaml:"host"`
+	Hosts   []string      `yaml:"hosts,omitempty"`   // more names, "*.example.com" or "~regex"
+	Default bool          `yaml:"default,omitempty"` // serves hosts no server on the listener matches
+	Routes  []RouteConfig `yaml:"routes"`
+
+	// static certificate for the server's names, autocert when empty. The
+	// cert file may hold the whole chain.
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+
+	ClientAuth *ClientAuthConfig `yaml:"client_auth,omitempty"` // mutual TLS
+	TLS        *TLSPolicy        `yaml:"tls,omitempty"`         // shared by every server on the listen address
+	HSTS       *HSTSConfig       `yaml:"hsts,omitempty"`        // Strict-Transport-Security on responses
+
+	Timeouts  *ListenerTimeouts `yaml:"timeouts,omitempty"`   // shared by every server on the listen address
+	RateLimit *RateLimitConfig  `yaml:"rate_limit,omitempty"` // applies to every route of the server
+
+	// applied to every route of the server, before the route's own
+	RequestHeaders  *HeaderRules `yaml:"request_headers,omitempty"`
+	ResponseHeaders *HeaderRules `yaml:"response_headers,omitempty"`
+}
+
+// ClientAuthConfig asks TLS clients of the server for a certificate
+type ClientAuthConfig struct {
+	Mode            string            `yaml:"mode,omitempty"`             // none, request, require or verify (default)
+	CAFiles         []string          `yaml:"ca_files,omitempty"`         // PEM bundles client certificates must chain to
+	CRLFiles        []string          `yaml:"crl_files,omitempty"`        // PEM or DER revocation lists
+	AllowedSubjects []string          `yaml:"allowed_subjects,omitempty"` // "CN=*,O=Acme" or "~regex", any if empty
+	AllowedSANs     []string          `yaml:"allowed_sans,omitempty"`     // DNS, email, IP or URI names
+	Headers         map[string]string `yaml:"headers,omitempty"`          // sent upstream, X-Client-Cert-Subject and X-Client-Cert by default
+}
+
+// TLSPolicy sets the TLS protocol of a listener. Empty fields keep the
+// defaults of Go.
+type TLSPolicy struct {
+	MinVersion        string        `yaml:"min_version,omitempty"`         // 1.0 to 1.3, default 1.2
+	MaxVersion        string        `yaml:"max_version,omitempty"`         // default 1.3
+	CipherSuites      []string      `yaml:"cipher_suites,omitempty"`       // TLS 1.2 suites by crypto/tls name, TLS 1.3 ones are fixed
+	Curves            []string      `yaml:"curves,omitempty"`              // X25519, P-256, P-384 or P-521
+	ALPN              []string      `yaml:"alpn,omitempty"`                // h2 and http/1.1 in order of preference, both by default
+	SessionTickets    *bool         `yaml:"session_tickets,omitempty"`     // default true
+	TicketKeyRotation time.Duration `yaml:"ticket_key_rotation,omitempty"` // daily by Go when empty, the last 3 keys still resume
+}
+
+// HSTSConfig tells browsers to only use HTTPS for the server's names
+type HSTSConfig struct {
+	MaxAge            time.Duration `yaml:"max_age,omitempty"` // default 8760h
+	IncludeSubdomains bool          `yaml:"include_subdomains,omitempty"`
+	Preload           bool          `yaml:"preload,omitempty"` // needs include_subdomains and a year of max_age
+}
+
+// HeaderRules change headers in the order remove, set, add. Values may use
+// the variables ${client_ip}, ${request_id}, ${host}, ${route}, ${upstream},
+// ${method}, ${uri} and ${scheme}.
+type HeaderRules struct {
+	Add    map[string]string `yaml:"add,omitempty"`    // appended to the existing values
+	Set    map[string]string `yaml:"set,omitempty"`    // replaces the existing values
+	Remove []string          `yaml:"remove,omitempty"` // "X-Backend-*" removes by prefix
+}
+
+// ListenerTimeouts are the http.Server timeouts of a listener, empty fields
+// mean no timeout
+type ListenerTimeouts struct {
+	ReadHeader time.Duration `yaml:"read_header,omitempty"`
+	Read       time.Duration `yaml:"read,omitempty"`
+	Write      time.Duration `yaml:"write,omitempty"` // also cuts off long downloads
+	Idle       time.Duration `yaml:"idle,omitempty"`  // keep-alive connections
+}
+
+// HostNames returns every name the server answers to
+func (server ServerConfig) HostNames() []string {
+	if server.Host == "" && len(server.Hosts) > 0 {
+		return server.Hosts
+	}
+	return append([]string{server.Host}, server.Hosts...)
 }
 
 type RouteConfig struct {
-	Match RouteMatch  `yaml:"match"`
-	Proxy ProxyConfig `yaml:"proxy"`
+	Name    string        `yaml:"name,omitempty"` // used in metrics, the match path by default
+	Match   RouteMatch    `yaml:"match"`
+	Rewrite RewriteConfig `yaml:"rewrite,omitempty"`
+	Proxy   ProxyConfig   `yaml:"proxy"`
+
+	RequestHeaders  *HeaderRules `yaml:"request_headers,omitempty"`  // sent upstream
+	ResponseHeaders *HeaderRules `yaml:"response_headers,omitempty"` // of upstream responses
+}
+
+// Label names the route in metrics
+func (route RouteConfig) Label() string {
+	if route.Name != "" {
+		return route.Name
+	}
+	return route.Match.Path
 }
 
 type RouteMatch struct {
-	Path string `yaml:"path"`
+	Path     string       `yaml:"path"`
+	PathType PathType     `yaml:"path_type,omitempty"` // prefix (default), exact or regex
+	Methods  []string     `yaml:"methods,omitempty"`
+	Headers  []ValueMatch `yaml:"headers,omitempty"`
+	Query    []ValueMatch `yaml:"query,omitempty"`
+	Cookies  []ValueMatch `yaml:"cookies,omitempty"`
+	Priority int          `yaml:"priority,omitempty"` // higher is tried first
+}
+
+// ValueMatch matches a header, query parameter or cookie by name. Without
+// value or regex the name only has to be present.
+type ValueMatch struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value,omitempty"`
+	Regex string `yaml:"regex,omitempty"`
+}
+
+// RewriteConfig changes the request before it is sent upstream. Prefix routes
+// strip the matched prefix by default.
+type RewriteConfig struct {
+	StripPrefix   *bool  `yaml:"strip_prefix,omitempty"`
+	ReplacePrefix string `yaml:"replace_prefix,omitempty"`
+	Regex         string `yaml:"regex,omitempty"`       // defaults to the path of a regex route
+	Replacement   string `yaml:"replacement,omitempty"` // may use $1 or ${name} captures
+	Host          string `yaml:"host,omitempty"`        // Host header sent upstream
 }
 
 type ProxyConfig struct {
-	Upstream []string       `yaml:"upstream"`
-	Strategy StrategyConfig `yaml:"strategy"`
+	Upstream         []string              `yaml:"upstream"`
+	Strategy         StrategyConfig        `yaml:"strategy"`
+	OutlierDetection *OutlierConfig        `yaml:"outlier_detection,omitempty"`
+	HealthCheck      *HealthCheckConfig    `yaml:"health_check,omitempty"`
+	Retry            *RetryConfig          `yaml:"retry,omitempty"`
+	Buffer           *BufferConfig         `yaml:"buffer,omitempty"`
+	Timeouts         *RouteTimeouts        `yaml:"timeouts,omitempty"`
+	UpstreamTLS      *UpstreamTLSConfig    `yaml:"upstream_tls,omitempty"` // for https upstreams, health checks included
+	CircuitBreaker   *CircuitBreakerConfig `yaml:"circuit_breaker,omitempty"`
+	RateLimit        *RateLimitConfig      `yaml:"rate_limit,omitempty"`
+	MaxConns         int                   `yaml:"max_conns,omitempty"` // concurrent requests per upstream server, 0 is unlimited
+	Queue            *QueueConfig          `yaml:"queue,omitempty"`     // waiting room once every upstream is at max_conns
+}
+
+// UpstreamTLSConfig sets how https upstreams are connected to. Empty fields
+// keep the defaults of the system.
+type UpstreamTLSConfig struct {
+	CAFiles            []string `yaml:"ca_files,omitempty"`             // PEM bundles trusted instead of the system roots
+	CertFile           string   `yaml:"cert_file,omitempty"`            // client certificate for upstream mTLS
+	KeyFile            string   `yaml:"key_file,omitempty"`             // its private key
+	ServerName         string   `yaml:"server_name,omitempty"`          // SNI and verified name, the upstream host by default
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify,omitempty"` // development only
+	MinVersion         string   `yaml:"min_version,omitempty"`          // 1.0 to 1.3, default 1.2
+}
+
+// QueueConfig bounds the requests waiting for an upstream connection
+type QueueConfig struct {
+	Size    int           `yaml:"size"`              // more waiting requests get a 503
+	Timeout time.Duration `yaml:"timeout,omitempty"` // longest wait before a 503, default 10s
+}
+
+// RateLimitConfig limits how many requests a client may send. Rejected
+// requests get a 429.
+type RateLimitConfig struct {
+	Algorithm string        `yaml:"algorithm,omitempty"` // token-bucket (default) or sliding-window
+	Requests  int           `yaml:"requests"`            // allowed per period
+	Period    time.Duration `yaml:"period,omitempty"`    // default 1s
+	Burst     int           `yaml:"burst,omitempty"`     // token bucket size, default requests
+	Key       string        `yaml:"key,omitempty"`       // ip (default), header, jwt or path
+	Name      string        `yaml:"name,omitempty"`      // header name or JWT claim
+	MaxKeys   int           `yaml:"max_keys,omitempty"`  // clients tracked at once, default 10000
+}
+
+// CircuitBreakerConfig stops traffic to an upstream server whose error rate
+// or slow call rate over the rolling window crosses the threshold
+type CircuitBreakerConfig struct {
+	Window           time.Duration `yaml:"window,omitempty"`             // rolling window, default 10s
+	MinRequests      int           `yaml:"min_requests,omitempty"`       // requests in the window before it can trip, default 20
+	ErrorPercent     int           `yaml:"error_percent,omitempty"`      // default 50
+	SlowCall         time.Duration `yaml:"slow_call,omitempty"`          // response header latency counted as slow, off when empty
+	SlowPercent      int           `yaml:"slow_percent,omitempty"`       // default 50
+	OpenDuration     time.Duration `yaml:"open_duration,omitempty"`      // default 30s
+	HalfOpenRequests int           `yaml:"half_open_requests,omitempty"` // probes that must pass to close, default 3
+}
+
+// RouteTimeouts limit how long proxying to the upstream may take. Timed out
+// requests get a 504.
+type RouteTimeouts struct {
+	Dial           time.Duration `yaml:"dial,omitempty"`            // connecting to the upstream, default 30s
+	TLSHandshake   time.Duration `yaml:"tls_handshake,omitempty"`   // default 10s
+	ResponseHeader time.Duration `yaml:"response_header,omitempty"` // after the request was sent, no limit by default
+	Request        time.Duration `yaml:"request,omitempty"`         // the whole request including retries and the response body
+	StreamIdle     time.Duration `yaml:"stream_idle,omitempty"`     // silence while reading the response body
+}
+
+// BufferConfig reads request bodies completely before proxying so retries
+// can replay them. Routes without it stream bodies unbuffered.
+type BufferConfig struct {
+	MaxBytes    int64  `yaml:"max_bytes,omitempty"`    // larger bodies get 413, default 10MB
+	MemoryBytes int64  `yaml:"memory_bytes,omitempty"` // larger bodies spill to disk, default 1MB
+	TempDir     string `yaml:"temp_dir,omitempty"`     // where bodies spill, the system temp dir when empty
+}
+
+// RetryConfig retries failed requests on another upstream. Methods that are
+// not idempotent are only retried when the request never reached the
+// upstream, unless RetryNonIdempotent is set.
+type RetryConfig struct {
+	Attempts           int           `yaml:"attempts"`                       // tries including the first one
+	On                 []string      `yaml:"on,omitempty"`                   // connect-failure, reset, timeout or a status code, default connect-failure, 502, 503, 504
+	PerTryTimeout      time.Duration `yaml:"per_try_timeout,omitempty"`      // time to wait for response headers on each try
+	Backoff            time.Duration `yaml:"backoff,omitempty"`              // default 25ms, doubles on every retry with full jitter
+	MaxBackoff         time.Duration `yaml:"max_backoff,omitempty"`          // default 250ms
+	RetryNonIdempotent bool          `yaml:"retry_non_idempotent,omitempty"` // retry POST and PATCH on every condition
+	BudgetPercent      int           `yaml:"budget_percent,omitempty"`       // retries allowed as percent of requests, default 20
+	BudgetMinRetries   int           `yaml:"budget_min_retries,omitempty"`   // retries always allowed per 10s, default 10
+}
+
+// HealthCheckConfig sets up the active health check of every upstream of
+// the route. Empty fields keep the defaults.
+type HealthCheckConfig struct {
+	Path              string            `yaml:"path,omitempty"`   // the upstream URL itself when empty
+	Method            string            `yaml:"method,omitempty"` // default GET
+	Headers           map[string]string `yaml:"headers,omitempty"`
+	ExpectedStatus    []string          `yaml:"expected_status,omitempty"` // "200" or "200-399", default 2xx
+	Body              string            `yaml:"body,omitempty"`            // substring the body must contain
+	BodyRegex         string            `yaml:"body_regex,omitempty"`
+	Interval          time.Duration     `yaml:"interval,omitempty"`           // default 10s
+	UnhealthyInterval time.Duration     `yaml:"unhealthy_interval,omitempty"` // interval while a server is down
+	Timeout           time.Duration     `yaml:"timeout,omitempty"`            // default 5s
+	Jitter            time.Duration     `yaml:"jitter,omitempty"`
+	Rise              int               `yaml:"rise,omitempty"` // default 1
+	Fall              int               `yaml:"fall,omitempty"` // default 3
+}
+
+// OutlierConfig ejects upstreams after consecutive 5xx or transport errors
+// on real traffic. Empty fields use the defaults.
+type OutlierConfig struct {
+	ConsecutiveErrors  int           `yaml:"consecutive_errors,omitempty"`   // default 5
+	BaseEjectionTime   time.Duration `yaml:"base_ejection_time,omitempty"`   // default 30s, grows with each ejection
+	MaxEjectionTime    time.Duration `yaml:"max_ejection_time,omitempty"`    // default 5m
+	MaxEjectionPercent int           `yaml:"max_ejection_percent,omitempty"` // default 50
 }
 
 type StrategyConfig struct {
 	Type   Strategy               `yaml:"type"`
 	Config map[string]interface{} `yaml:"config,omitempty"`
+	Sticky *StickyConfig          `yaml:"sticky,omitempty"`
+}
+
+// StickyConfig pins clients to the upstream picked for their first request
+// with a signed cookie. Type is the strategy used when there is no valid
+// cookie or its server is down.
+type StickyConfig struct {
+	Cookie   string        `yaml:"cookie,omitempty"`    // defaults to GRP_AFFINITY
+	TTL      time.Duration `yaml:"ttl,omitempty"`       // session cookie when empty
+	SameSite string        `yaml:"same_site,omitempty"` // lax (default), strict or none
+	Secure   bool          `yaml:"secure,omitempty"`
+	Key      string        `yaml:"key,omitempty"` // signing key, random per process when empty
+}
+
+// hashKey returns the hash key source and header or cookie name of the
+// consistent hash strategy
+func (sc StrategyConfig) hashKey() (string, string) {
+	source, _ := sc.Config["key"].(string)
+	name, _ := sc.Config["name"].(string)
+	if source == "" {
+		source = HashKeyIP
+	}
+	return source, name
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -53,11 +367,356 @@ func LoadConfig(filename string) (*Config, error) {
 	return &config, nil
 }
 
+// WatchFile polls filename every interval and sends on the returned channel
+// when its modification time or size changes, until done is closed
+func WatchFile(filename string, interval time.Duration, done <-chan struct{}) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last, _ := os.Stat(filename)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(filename)
+			if err != nil {
+				continue
+			}
+
+			if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+				last = info
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return changes
+}
+
+// GetAllDomains returns the concrete host names for certificates. Wildcard
+// and regex names can't be whitelisted and are left out, so are the names
+// of servers with a static certificate.
 func (cfg *Config) GetAllDomains() []string {
 	var domains []string
+	seen := make(map[string]bool)
 	for _, server := range cfg.Servers {
-		domains = append(domains, server.Host)
+		if server.CertFile != "" {
+			continue
+		}
+		for _, name := range server.HostNames() {
+			if name == "" || isWildcardHost(name) || isRegexHost(name) {
+				continue
+			}
+
+			domain := stripPort(name)
+			if !seen[domain] {
+				seen[domain] = true
+				domains = append(domains, domain)
+			}
+		}
 	}
 
 	return domains
 }
+
+// Validate checks the config before any proxy server is built from it
+func (cfg *Config) Validate() error {
+	if len(cfg.Servers) == 0 {
+		return fmt.Errorf("no servers configured")
+	}
+
+	if cfg.AccessLog != nil {
+		if err := cfg.AccessLog.validate(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Forwarding != nil {
+		if err := cfg.Forwarding.validate(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ACME != nil {
+		if err := cfg.ACME.validate(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.HTTPRedirect != nil {
+		if err := cfg.HTTPRedirect.validate(); err != nil {
+			return err
+		}
+		if cfg.ACME != nil && cfg.ACME.httpChallenge() && cfg.HTTPRedirect.Listen != "" && cfg.HTTPRedirect.Listen != cfg.ACME.challengeListen() {
+			return fmt.Errorf("http_redirect: listen %s differs from acme challenge_listen %s", cfg.HTTPRedirect.Listen, cfg.ACME.challengeListen())
+		}
+	}
+
+	// only checked when configured, so existing configs may keep using :80
+	challengeListen := ""
+	if cfg.ACME != nil || cfg.HTTPRedirect != nil {
+		challengeListen = cfg.ChallengeAddress()
+	}
+	if challengeListen != "" && cfg.Admin != nil && challengeListen == cfg.Admin.Listen {
+		return fmt.Errorf("challenge listener %s is used by the admin listener", challengeListen)
+	}
+
+	if cfg.Admin != nil {
+		if cfg.Admin.Listen == "" {
+			return fmt.Errorf("admin: listen is required")
+		}
+		if !strings.HasPrefix(cfg.Admin.metricsPath(), "/") {
+			return fmt.Errorf("admin: metrics_path must start with /")
+		}
+	}
+
+	// servers may share a listen address on purpose, but then they must
+	// agree on ssl and serve different hosts
+	listenSsl := make(map[string]bool)
+	listenTimeouts := make(map[string]*ListenerTimeouts)
+	listenTLS := make(map[string]*TLSPolicy)
+	listenHosts := make(map[string]int)
+	listenDefault := make(map[string]int)
+
+	for i, server := range cfg.Servers {
+		if cfg.Admin != nil && server.Listen == cfg.Admin.Listen {
+			return fmt.Errorf("servers[%d]: listen %s is used by the admin listener", i, server.Listen)
+		}
+
+		if server.Listen == "" {
+			return fmt.Errorf("servers[%d]: listen is required", i)
+		}
+
+		if challengeListen != "" && server.Listen == challengeListen {
+			return fmt.Errorf("servers[%d]: listen %s is used by the challenge listener", i, server.Listen)
+		}
+
+		if ssl, ok := listenSsl[server.Listen]; ok && ssl != server.Ssl {
+			return fmt.Errorf("servers[%d]: listen %s is shared with conflicting ssl setting", i, server.Listen)
+		}
+		listenSsl[server.Listen] = server.Ssl
+
+		if (server.CertFile == "") != (server.KeyFile == "") {
+			return fmt.Errorf("servers[%d]: cert_file and key_file must be set together", i)
+		}
+		if server.ClientAuth != nil {
+			if !server.Ssl {
+				return fmt.Errorf("servers[%d]: client_auth needs ssl", i)
+			}
+			if _, err := newClientAuth(*server.ClientAuth); err != nil {
+				return fmt.Errorf("servers[%d]: %v", i, err)
+			}
+		}
+		if server.CertFile != "" {
+			if !server.Ssl {
+				return fmt.Errorf("servers[%d]: cert_file needs ssl", i)
+			}
+			if _, err := loadKeyPair(server.CertFile, server.KeyFile); err != nil {
+				return fmt.Errorf("servers[%d]: %v", i, err)
+			}
+		}
+
+		if policy := server.TLS; policy != nil {
+			if !server.Ssl {
+				return fmt.Errorf("servers[%d]: tls needs ssl", i)
+			}
+			if _, err := newTLSPolicy(*policy); err != nil {
+				return fmt.Errorf("servers[%d]: %v", i, err)
+			}
+			if other, ok := listenTLS[server.Listen]; ok && !reflect.DeepEqual(other, policy) {
+				return fmt.Errorf("servers[%d]: listen %s is shared with a conflicting tls policy", i, server.Listen)
+			}
+			listenTLS[server.Listen] = policy
+		}
+		if hsts := server.HSTS; hsts != nil {
+			if !server.Ssl {
+				return fmt.Errorf("servers[%d]: hsts needs ssl", i)
+			}
+			if err := hsts.validate(); err != nil {
+				return fmt.Errorf("servers[%d]: %v", i, err)
+			}
+		}
+
+		if t := server.Timeouts; t != nil {
+			if err := t.validate(); err != nil {
+				return fmt.Errorf("servers[%d]: %v", i, err)
+			}
+			if other, ok := listenTimeouts[server.Listen]; ok && *other != *t {
+				return fmt.Errorf("servers[%d]: listen %s is shared with conflicting timeouts", i, server.Listen)
+			}
+			listenTimeouts[server.Listen] = t
+		}
+
+		if rl := server.RateLimit; rl != nil {
+			if _, err := newRateLimiter(*rl); err != nil {
+				return fmt.Errorf("servers[%d]: %v", i, err)
+			}
+		}
+
+		for _, rules := range []*HeaderRules{server.RequestHeaders, server.ResponseHeaders} {
+			if rules != nil {
+				if _, err := compileHeaderRules(*rules); err != nil {
+					return fmt.Errorf("servers[%d]: %v", i, err)
+				}
+			}
+		}
+
+		for _, name := range server.HostNames() {
+			if isRegexHost(name) {
+				if _, err := compileHostRegex(name); err != nil {
+					return fmt.Errorf("servers[%d]: %v", i, err)
+				}
+			}
+
+			key := server.Listen + "|" + normalizeHost(name)
+			if j, ok := listenHosts[key]; ok {
+				return fmt.Errorf("servers[%d]: host %q on listen %s is already configured by servers[%d]", i, name, server.Listen, j)
+			}
+			listenHosts[key] = i
+		}
+
+		if server.Default {
+			if j, ok := listenDefault[server.Listen]; ok {
+				return fmt.Errorf("servers[%d]: listen %s already has default server servers[%d]", i, server.Listen, j)
+			}
+			listenDefault[server.Listen] = i
+		}
+
+		// routes are told apart across reloads by their match
+		routeMatches := make(map[string]int)
+		routeNames := make(map[string]int)
+		for j, route := range server.Routes {
+			match, err := compileRouteMatch(route.Match)
+			if err != nil {
+				return fmt.Errorf("servers[%d].routes[%d]: %v", i, j, err)
+			}
+
+			key := routeKey(server, route)
+			if k, ok := routeMatches[key]; ok {
+				return fmt.Errorf("servers[%d].routes[%d]: same match as servers[%d].routes[%d]", i, j, i, k)
+			}
+			routeMatches[key] = j
+
+			// names label the metrics of a route
+			if route.Name != "" {
+				if k, ok := routeNames[route.Name]; ok {
+					return fmt.Errorf("servers[%d].routes[%d]: name %q already used by servers[%d].routes[%d]", i, j, route.Name, i, k)
+				}
+				routeNames[route.Name] = j
+			}
+
+			if _, err := compileRewrite(route.Rewrite, match); err != nil {
+				return fmt.Errorf("servers[%d].routes[%d]: %v", i, j, err)
+			}
+
+			for _, rules := range []*HeaderRules{route.RequestHeaders, route.ResponseHeaders} {
+				if rules != nil {
+					if _, err := compileHeaderRules(*rules); err != nil {
+						return fmt.Errorf("servers[%d].routes[%d]: %v", i, j, err)
+					}
+				}
+			}
+
+			if len(route.Proxy.Upstream) == 0 {
+				return fmt.Errorf("servers[%d].routes[%d]: no upstream configured", i, j)
+			}
+
+			for _, rawURL := range route.Proxy.Upstream {
+				if _, err := url.Parse(rawURL); err != nil {
+					return fmt.Errorf("servers[%d].routes[%d]: invalid upstream URL %s: %v", i, j, rawURL, err)
+				}
+			}
+
+			if cb := route.Proxy.CircuitBreaker; cb != nil && (cb.ErrorPercent < 0 || cb.ErrorPercent > 100 || cb.SlowPercent < 0 || cb.SlowPercent > 100) {
+				return fmt.Errorf("servers[%d].routes[%d]: circuit breaker percents must be between 0 and 100", i, j)
+			}
+
+			if od := route.Proxy.OutlierDetection; od != nil && (od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100) {
+				return fmt.Errorf("servers[%d].routes[%d]: max_ejection_percent must be between 0 and 100", i, j)
+			}
+
+			if retry := route.Proxy.Retry; retry != nil {
+				if _, err := compileRetryPolicy(*retry); err != nil {
+					return fmt.Errorf("servers[%d].routes[%d]: %v", i, j, err)
+				}
+			}
+
+			if t := route.Proxy.Timeouts; t != nil {
+				if err := t.validate(); err != nil {
+					return fmt.Errorf("servers[%d].routes[%d]: %v", i, j, err)
+				}
+			}
+
+			if rl := route.Proxy.RateLimit; rl != nil {
+				if _, err := newRateLimiter(*rl); err != nil {
+					return fmt.Errorf("servers[%d].routes[%d]: %v", i, j, err)
+				}
+			}
+
+			if ut := route.Proxy.UpstreamTLS; ut != nil {
+				if _, err := newUpstreamTLS(*ut); err != nil {
+					return fmt.Errorf("servers[%d].routes[%d]: %v", i, j, err)
+				}
+			}
+
+			if route.Proxy.MaxConns < 0 {
+				return fmt.Errorf("servers[%d].routes[%d]: max_conns must not be negative", i, j)
+			}
+			if queue := route.Proxy.Queue; queue != nil {
+				if route.Proxy.MaxConns == 0 {
+					return fmt.Errorf("servers[%d].routes[%d]: queue needs max_conns", i, j)
+				}
+				if queue.Size < 1 {
+					return fmt.Errorf("servers[%d].routes[%d]: queue size must be at least 1", i, j)
+				}
+			}
+
+			if buffer := route.Proxy.Buffer; buffer != nil {
+				if _, err := newBodyBuffer(*buffer); err != nil {
+					return fmt.Errorf("servers[%d].routes[%d]: %v", i, j, err)
+				}
+			}
+
+			if hc := route.Proxy.HealthCheck; hc != nil {
+				if _, err := compileHealthProbe(*hc); err != nil {
+					return fmt.Errorf("servers[%d].routes[%d]: %v", i, j, err)
+				}
+			}
+
+			if sticky := route.Proxy.Strategy.Sticky; sticky != nil {
+				switch strings.ToLower(sticky.SameSite) {
+				case "", "lax", "strict", "none":
+				default:
+					return fmt.Errorf("servers[%d].routes[%d]: unknown same_site %q", i, j, sticky.SameSite)
+				}
+			}
+
+			switch route.Proxy.Strategy.Type {
+			case "", RoundRobin, LeastConnections, IPHash, WeightedRR:
+			case ConsistentHash:
+				switch source, name := route.Proxy.Strategy.hashKey(); source {
+				case HashKeyIP, HashKeyURI:
+				case HashKeyHeader, HashKeyCookie:
+					if name == "" {
+						return fmt.Errorf("servers[%d].routes[%d]: hash key %s needs a name", i, j, source)
+					}
+				default:
+					return fmt.Errorf("servers[%d].routes[%d]: unknown hash key %q", i, j, source)
+				}
+			default:
+				return fmt.Errorf("servers[%d].routes[%d]: unknown strategy %q", i, j, route.Proxy.Strategy.Type)
+			}
+		}
+	}
+
+	return nil
+}
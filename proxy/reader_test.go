@@ -3,6 +3,7 @@ package proxy
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -100,8 +101,122 @@ func TestGetAllDomains(t *testing.T) {
 		},
 	}
 
-	expected := []string{"example.com", "test.com"}
+	// wildcard and regex names can't get a certificate, ports are dropped
+	cfg.Servers[1].Hosts = []string{"*.test.com", `~^shop[0-9]+\.test\.com$`, "www.test.com:443"}
+
+	expected := []string{"example.com", "test.com", "www.test.com"}
 	actualDomains := cfg.GetAllDomains()
 
 	assert.ElementsMatch(t, expected, actualDomains, "Domains fail. expected: %v, actual %v", expected, actualDomains)
 }
+
+func TestValidate(t *testing.T) {
+	route := RouteConfig{
+		Match: RouteMatch{Path: "/"},
+		Proxy: ProxyConfig{Upstream: []string{"http://localhost:8081"}},
+	}
+
+	tests := []struct {
+		name    string
+		servers []ServerConfig
+		wantErr bool
+	}{
+		{
+			name: "shared listener",
+			servers: []ServerConfig{
+				{Listen: ":443", Ssl: true, Host: "example.com", Routes: []RouteConfig{route}},
+				{Listen: ":443", Ssl: true, Host: "test.com", Routes: []RouteConfig{route}},
+			},
+		},
+		{
+			name: "conflicting listener timeouts",
+			servers: []ServerConfig{
+				{Listen: ":443", Ssl: true, Host: "example.com", Routes: []RouteConfig{route}, Timeouts: &ListenerTimeouts{Idle: time.Minute}},
+				{Listen: ":443", Ssl: true, Host: "test.com", Routes: []RouteConfig{route}, Timeouts: &ListenerTimeouts{Idle: time.Second}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "same host on different listeners",
+			servers: []ServerConfig{
+				{Listen: ":443", Ssl: true, Host: "example.com", Routes: []RouteConfig{route}},
+				{Listen: ":8080", Host: "example.com", Routes: []RouteConfig{route}},
+			},
+		},
+		{
+			name: "duplicate host and listen",
+			servers: []ServerConfig{
+				{Listen: ":443", Ssl: true, Host: "example.com", Routes: []RouteConfig{route}},
+				{Listen: ":443", Ssl: true, Host: "example.com", Routes: []RouteConfig{route}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "conflicting ssl on shared listener",
+			servers: []ServerConfig{
+				{Listen: ":443", Ssl: true, Host: "example.com", Routes: []RouteConfig{route}},
+				{Listen: ":443", Ssl: false, Host: "test.com", Routes: []RouteConfig{route}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate name in host list",
+			servers: []ServerConfig{
+				{Listen: ":443", Ssl: true, Host: "example.com", Routes: []RouteConfig{route}},
+				{Listen: ":443", Ssl: true, Hosts: []string{"test.com", "Example.com:443"}, Routes: []RouteConfig{route}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "two default servers on one listener",
+			servers: []ServerConfig{
+				{Listen: ":443", Ssl: true, Host: "example.com", Default: true, Routes: []RouteConfig{route}},
+				{Listen: ":443", Ssl: true, Host: "test.com", Default: true, Routes: []RouteConfig{route}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid host regex",
+			servers: []ServerConfig{
+				{Listen: ":443", Ssl: true, Host: "~(", Routes: []RouteConfig{route}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate route match",
+			servers: []ServerConfig{
+				{Listen: ":8080", Host: "example.com", Routes: []RouteConfig{route, route}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate route name",
+			servers: []ServerConfig{
+				{Listen: ":8080", Host: "example.com", Routes: []RouteConfig{
+					{Name: "api", Match: RouteMatch{Path: "/a"}, Proxy: route.Proxy},
+					{Name: "api", Match: RouteMatch{Path: "/b"}, Proxy: route.Proxy},
+				}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing upstream",
+			servers: []ServerConfig{
+				{Listen: ":8080", Host: "example.com", Routes: []RouteConfig{{Match: RouteMatch{Path: "/"}}}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Servers: tt.servers}
+			err := cfg.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Header carrying the request ID to the upstream
+const requestIDHeader = "X-Request-ID"
+
+type requestInfoKey struct{}
+
+// requestInfo follows a request from the listener through the route and the
+// proxy server, for metrics and the access log
+type requestInfo struct {
+	listener    string
+	uri         string // as received, before any rewrite
+	requestHost string // the Host header as received
+	clientIP    string
+	requestID   string
+	start       time.Time
+
+	// set once a route matched
+	host    string // the configured host, not the Host header
+	route   string
+	metrics *routeMetrics
+
+	// set by the proxy server
+	upstream string // last upstream tried, empty when none was
+	retries  int
+
+	bytesIn atomic.Int64
+}
+
+func newRequestInfo(listener string, r *http.Request) *requestInfo {
+	return &requestInfo{
+		listener:    listener,
+		uri:         r.URL.RequestURI(),
+		requestHost: r.Host,
+		clientIP:    stripPort(r.RemoteAddr),
+		start:       time.Now(),
+	}
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// ensureRequestID gives the request an ID when it has none yet and sends it
+// upstream with r
+func (info *requestInfo) ensureRequestID(r *http.Request) string {
+	if info.requestID == "" {
+		info.requestID = requestID(r)
+	}
+	r.Header.Set(requestIDHeader, info.requestID)
+	return info.requestID
+}
+
+// requestID returns the ID sent by the client, or a new random one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= 128 {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// countingBody counts the request bytes read by the proxy
+type countingBody struct {
+	io.ReadCloser
+	info *requestInfo
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.info.bytesIn.Add(int64(n))
+	return n, err
+}
+
+// clientIP returns the client address worked out from the trusted proxies,
+// the peer address when the request did not come through a listener
+func clientIP(r *http.Request) string {
+	if info := requestInfoFrom(r.Context()); info != nil && info.clientIP != "" {
+		return info.clientIP
+	}
+	return stripPort(r.RemoteAddr)
+}
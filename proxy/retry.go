@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Retry conditions besides plain status codes
+const (
+	RetryOnConnectFailure = "connect-failure" // the upstream could not be reached, the request was never sent
+	RetryOnReset          = "reset"           // the connection failed before a response arrived
+	RetryOnTimeout        = "timeout"         // the per-try timeout expired before a response arrived
+)
+
+// Defaults for retry policies when the config leaves a field empty
+const (
+	defaultRetryBackoff       = 25 * time.Millisecond
+	defaultRetryMaxBackoff    = 250 * time.Millisecond
+	defaultRetryBudgetPercent = 20
+	defaultRetryBudgetMin     = 10
+	retryBudgetWindow         = 10 * time.Second
+)
+
+var defaultRetryOn = []string{RetryOnConnectFailure, "502", "503", "504"}
+
+// errRetry tells the ErrorHandler a response was dropped to be retried
+var errRetry = errors.New("response dropped for retry")
+
+// retryPolicy is the compiled form of a RetryConfig
+type retryPolicy struct {
+	attempts           int
+	onConnectFailure   bool
+	onReset            bool
+	onTimeout          bool
+	statuses           map[int]bool
+	perTryTimeout      time.Duration
+	backoff            time.Duration
+	maxBackoff         time.Duration
+	retryNonIdempotent bool
+	budget             *retryBudget
+}
+
+func compileRetryPolicy(cfg RetryConfig) (*retryPolicy, error) {
+	rp := &retryPolicy{
+		attempts:           cfg.Attempts,
+		statuses:           make(map[int]bool),
+		perTryTimeout:      cfg.PerTryTimeout,
+		backoff:            cfg.Backoff,
+		maxBackoff:         cfg.MaxBackoff,
+		retryNonIdempotent: cfg.RetryNonIdempotent,
+	}
+
+	if rp.attempts < 1 {
+		return nil, fmt.Errorf("retry attempts must be at least 1")
+	}
+	if rp.backoff <= 0 {
+		rp.backoff = defaultRetryBackoff
+	}
+	if rp.maxBackoff <= 0 {
+		rp.maxBackoff = defaultRetryMaxBackoff
+	}
+
+	on := cfg.On
+	if len(on) == 0 {
+		on = defaultRetryOn
+	}
+	for _, condition := range on {
+		switch condition {
+		case RetryOnConnectFailure:
+			rp.onConnectFailure = true
+		case RetryOnReset:
+			rp.onReset = true
+		case RetryOnTimeout:
+			rp.onTimeout = true
+		default:
+			status, err := strconv.Atoi(condition)
+			if err != nil || status < 100 || status > 599 {
+				return nil, fmt.Errorf("unknown retry condition %q", condition)
+			}
+			rp.statuses[status] = true
+		}
+	}
+
+	percent := cfg.BudgetPercent
+	if percent <= 0 {
+		percent = defaultRetryBudgetPercent
+	}
+	minRetries := cfg.BudgetMinRetries
+	if minRetries <= 0 {
+		minRetries = defaultRetryBudgetMin
+	}
+	rp.budget = newRetryBudget(percent, minRetries)
+
+	return rp, nil
+}
+
+// isIdempotent reports whether a request with method can safely be sent twice
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// replayable reports whether the request body can be sent again
+func replayable(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+}
+
+// retryOnError reports whether a failed round trip may be retried. A request
+// that never reached the upstream can always be retried, anything else only
+// when the method is idempotent.
+func (rp *retryPolicy) retryOnError(r *http.Request, err error, timedOut bool) bool {
+	if isConnectFailure(err) {
+		return rp.onConnectFailure
+	}
+	if !isIdempotent(r.Method) && !rp.retryNonIdempotent {
+		return false
+	}
+	if timedOut {
+		return rp.onTimeout
+	}
+	return rp.onReset
+}
+
+func (rp *retryPolicy) retryOnStatus(r *http.Request, status int) bool {
+	if !isIdempotent(r.Method) && !rp.retryNonIdempotent {
+		return false
+	}
+	return rp.statuses[status]
+}
+
+// backoffFor returns the full jitter exponential backoff before retry n
+func (rp *retryPolicy) backoffFor(n int) time.Duration {
+	d := rp.backoff << (n - 1)
+	if d <= 0 || d > rp.maxBackoff {
+		d = rp.maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+func isConnectFailure(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryBudget caps retries to a share of the requests seen in the current
+// window, with a floor so low traffic routes can still retry
+type retryBudget struct {
+	percent    int
+	minRetries int
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func newRetryBudget(percent int, minRetries int) *retryBudget {
+	return &retryBudget{percent: percent, minRetries: minRetries, windowStart: time.Now()}
+}
+
+func (b *retryBudget) roll() {
+	if time.Since(b.windowStart) > retryBudgetWindow {
+		b.windowStart = time.Now()
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// request counts one incoming request
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	b.requests++
+}
+
+// available reports whether a retry would still fit the budget
+func (b *retryBudget) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	return b.retries < b.minRetries || b.retries*100 < b.requests*b.percent
+}
+
+// spend counts one retry
+func (b *retryBudget) spend() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	b.retries++
+}
+
+type attemptKey struct{}
+
+// attempt carries the state of one try to an upstream through the
+// ReverseProxy callbacks
+type attempt struct {
+	policy     *retryPolicy      // nil when the attempt can't be retried
+	cookie     *http.Cookie      // affinity cookie for the response
+	transport  http.RoundTripper // nil uses the default transport
+	streamIdle time.Duration
+	cancel     context.CancelFunc
+	server     *UpstreamServer
+	headers    []*headerRules // applied to the response
+	probe      bool           // a half-open circuit probe
+	start      time.Time      // when the attempt was sent
+	latency    time.Duration
+	status     int
+	err        error
+	retry      bool // the attempt failed in a retryable way and wrote nothing
+	timedOut   bool
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func attemptFrom(ctx context.Context) *attempt {
+	at, _ := ctx.Value(attemptKey{}).(*attempt)
+	return at
+}
+
+// failed reports whether the attempt counts against the upstream
+func (at *attempt) failed() bool {
+	return (at.err != nil && at.err != errRetry) || at.status >= http.StatusInternalServerError
+}
+
+// startTimer cancels the attempt when no response arrives within timeout
+func (at *attempt) startTimer(timeout time.Duration, cancel context.CancelFunc) {
+	if timeout <= 0 {
+		return
+	}
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.timer = time.AfterFunc(timeout, func() {
+		at.mu.Lock()
+		at.timedOut = true
+		at.mu.Unlock()
+		cancel()
+	})
+}
+
+// stopTimer stops the per-try timer once the response headers arrived, so
+// long bodies are not cut off
+func (at *attempt) stopTimer() {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if at.timer != nil {
+		at.timer.Stop()
+	}
+}
+
+func (at *attempt) isTimedOut() bool {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.timedOut
+}
+
+// modifyResponse is the ReverseProxy.ModifyResponse of every upstream
+func modifyResponse(resp *http.Response) error {
+	at := attemptFrom(resp.Request.Context())
+	if at == nil {
+		return nil
+	}
+
+	at.stopTimer()
+	at.status = resp.StatusCode
+	at.latency = time.Since(at.start)
+
+	if at.policy != nil && at.policy.retryOnStatus(resp.Request, resp.StatusCode) {
+		at.retry = true
+		return errRetry
+	}
+
+	if len(at.headers) > 0 {
+		vars := headerVariables(resp.Request, at.server)
+		for _, rules := range at.headers {
+			rules.apply(resp.Header, vars)
+		}
+	}
+
+	if at.cookie != nil {
+		resp.Header.Add("Set-Cookie", at.cookie.String())
+	}
+
+	// upgraded connections are not read through the body
+	if at.streamIdle > 0 && at.cancel != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = newIdleTimeoutBody(resp.Body, at.streamIdle, at.cancel)
+	}
+	return nil
+}
+
+// handleProxyError is the ReverseProxy.ErrorHandler of every upstream.
+// Timeouts get a 504, anything else a 503.
+func handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	timeout := timeoutKind(r, err)
+
+	at := attemptFrom(r.Context())
+	if at != nil {
+		if at.retry {
+			return
+		}
+		at.err = err
+		at.latency = time.Since(at.start)
+		if at.isTimedOut() {
+			timeout = TimeoutPerTry
+		}
+		// the total request timeout leaves no time for another try
+		if timeout != TimeoutRequest && at.policy != nil && at.policy.retryOnError(r, err, timeout != "") {
+			at.retry = true
+			return
+		}
+	}
+
+	if timeout != "" {
+		log.Printf("代理逾時 [%s]: %v", timeout, err)
+		http.Error(w, "Upstream timed out", http.StatusGatewayTimeout)
+		return
+	}
+
+	log.Printf("代理錯誤: %v", err)
+	http.Error(w, "服務暫時不可用", http.StatusServiceUnavailable)
+}
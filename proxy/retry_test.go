@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newRetryProxy(t *testing.T, cfg RetryConfig, upstreamURLs ...string) *ProxyServer {
+	proxyServer, err := NewProxyServer(upstreamURLs)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := proxyServer.SetRetry(cfg); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return proxyServer
+}
+
+func TestProxyServer_Retry(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL := closed.URL
+	closed.Close()
+
+	t.Run("retries on another upstream", func(t *testing.T) {
+		proxyServer := newRetryProxy(t, RetryConfig{Attempts: 2}, unavailable.URL, healthy.URL)
+		for i := 0; i < 6; i++ {
+			rr := httptest.NewRecorder()
+			proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+			assert.Equal(t, http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("passes the last failure through", func(t *testing.T) {
+		proxyServer := newRetryProxy(t, RetryConfig{Attempts: 3}, unavailable.URL)
+		rr := httptest.NewRecorder()
+		proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	})
+
+	t.Run("connect failure is retried for any method", func(t *testing.T) {
+		proxyServer := newRetryProxy(t, RetryConfig{Attempts: 2}, closedURL, healthy.URL)
+		for i := 0; i < 4; i++ {
+			rr := httptest.NewRecorder()
+			proxyServer.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost", nil))
+			assert.Equal(t, http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("status is not retried for non idempotent methods", func(t *testing.T) {
+		proxyServer := newRetryProxy(t, RetryConfig{Attempts: 2}, unavailable.URL)
+		rr := httptest.NewRecorder()
+		proxyServer.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	})
+
+	t.Run("body that can't be replayed is not retried", func(t *testing.T) {
+		proxyServer := newRetryProxy(t, RetryConfig{Attempts: 2}, closedURL)
+		req := httptest.NewRequest("PUT", "http://localhost", strings.NewReader("payload"))
+		req.GetBody = nil
+		rr := httptest.NewRecorder()
+		proxyServer.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	})
+}
+
+func TestProxyServer_RetryPerTryTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server-ID", "fast")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fast.Close()
+
+	proxyServer := newRetryProxy(t, RetryConfig{
+		Attempts:      2,
+		On:            []string{RetryOnTimeout},
+		PerTryTimeout: 50 * time.Millisecond,
+	}, slow.URL, fast.URL)
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "fast", rr.Header().Get("Server-ID"))
+	}
+
+	// out of attempts the client gets a gateway timeout
+	proxyServer = newRetryProxy(t, RetryConfig{Attempts: 1, PerTryTimeout: 50 * time.Millisecond}, slow.URL)
+	rr := httptest.NewRecorder()
+	proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := newRetryBudget(20, 2)
+
+	// the floor allows a few retries without traffic
+	assert.True(t, budget.available())
+	budget.spend()
+	budget.spend()
+	assert.False(t, budget.available(), "Expected the floor to be used up")
+
+	// 20 percent of 20 requests allows 4 retries
+	for i := 0; i < 20; i++ {
+		budget.request()
+	}
+	budget.spend()
+	budget.spend()
+	assert.False(t, budget.available(), "Expected the budget to be used up")
+}
+
+func TestCompileRetryPolicy(t *testing.T) {
+	_, err := compileRetryPolicy(RetryConfig{})
+	assert.Error(t, err, "Expected attempts to be required")
+
+	_, err = compileRetryPolicy(RetryConfig{Attempts: 2, On: []string{"sometimes"}})
+	assert.Error(t, err, "Expected unknown condition to fail")
+
+	rp, err := compileRetryPolicy(RetryConfig{Attempts: 3, Backoff: 10 * time.Millisecond, MaxBackoff: 15 * time.Millisecond})
+	assert.NoError(t, err)
+	for n := 1; n < 5; n++ {
+		assert.LessOrEqual(t, rp.backoffFor(n), 15*time.Millisecond)
+	}
+}
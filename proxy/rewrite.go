@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// pathRewriter is the compiled form of a RewriteConfig
+type pathRewriter struct {
+	stripPrefix   bool
+	replacePrefix string
+	regex         *regexp.Regexp
+	replacement   string
+	host          string
+}
+
+func compileRewrite(cfg RewriteConfig, match *routeMatcher) (*pathRewriter, error) {
+	rw := &pathRewriter{
+		// prefix routes strip the matched prefix unless told otherwise
+		stripPrefix:   cfg.StripPrefix == nil || *cfg.StripPrefix,
+		replacePrefix: cfg.ReplacePrefix,
+		replacement:   cfg.Replacement,
+		host:          cfg.Host,
+	}
+
+	if cfg.ReplacePrefix != "" {
+		rw.stripPrefix = true
+	}
+
+	switch {
+	case cfg.Regex != "":
+		re, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite regex %q: %v", cfg.Regex, err)
+		}
+		rw.regex = re
+	case cfg.Replacement != "":
+		// a regex route rewrites with its own captures
+		if match.pathRegex == nil {
+			return nil, fmt.Errorf("rewrite replacement needs a regex")
+		}
+		rw.regex = match.pathRegex
+	}
+
+	return rw, nil
+}
+
+// rewrite changes the request the way the route is configured before it is
+// handed to the upstream
+func (rw *pathRewriter) rewrite(r *http.Request, match *routeMatcher) {
+	switch {
+	case rw.regex != nil:
+		if rw.regex.MatchString(r.URL.Path) {
+			path := rw.regex.ReplaceAllString(r.URL.Path, rw.replacement)
+			rawPath := ""
+			if r.URL.RawPath != "" {
+				rawPath = rw.regex.ReplaceAllString(r.URL.RawPath, rw.replacement)
+			}
+			setPath(r.URL, path, rawPath)
+		}
+	case match.pathType == PathPrefix && rw.stripPrefix:
+		path := joinPrefix(rw.replacePrefix, strings.TrimPrefix(r.URL.Path, match.path))
+		rawPath := ""
+		if r.URL.RawPath != "" && strings.HasPrefix(r.URL.RawPath, match.path) {
+			rawPath = joinPrefix(rw.replacePrefix, r.URL.RawPath[len(match.path):])
+		}
+		setPath(r.URL, path, rawPath)
+	}
+
+	if rw.host != "" {
+		r.Host = rw.host
+	}
+}
+
+// joinPrefix puts prefix in front of rest with exactly one slash between them
+func joinPrefix(prefix string, rest string) string {
+	if prefix == "" {
+		return rest
+	}
+	if strings.HasSuffix(prefix, "/") && strings.HasPrefix(rest, "/") {
+		return prefix + rest[1:]
+	}
+	if !strings.HasSuffix(prefix, "/") && rest != "" && !strings.HasPrefix(rest, "/") {
+		return prefix + "/" + rest
+	}
+	return prefix + rest
+}
+
+// setPath sets the decoded and encoded path of u. The path never ends up
+// empty, and rawPath is only kept when it is a valid encoding of path so the
+// client's original escaping is forwarded unchanged.
+func setPath(u *url.URL, path string, rawPath string) {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if rawPath != "" && !strings.HasPrefix(rawPath, "/") {
+		rawPath = "/" + rawPath
+	}
+
+	u.Path = path
+	u.RawPath = ""
+	if rawPath != "" {
+		if decoded, err := url.PathUnescape(rawPath); err == nil && decoded == path {
+			u.RawPath = rawPath
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathRewriter_Rewrite(t *testing.T) {
+	keep := false
+
+	tests := []struct {
+		name        string
+		match       RouteMatch
+		rewrite     RewriteConfig
+		target      string
+		wantPath    string
+		wantRawPath string
+		wantHost    string
+	}{
+		{
+			name:     "strip prefix by default",
+			match:    RouteMatch{Path: "/path1"},
+			target:   "/path1/items",
+			wantPath: "/items",
+		},
+		{
+			name:     "never empty",
+			match:    RouteMatch{Path: "/path1"},
+			target:   "/path1",
+			wantPath: "/",
+		},
+		{
+			name:     "keep full path",
+			match:    RouteMatch{Path: "/path1"},
+			rewrite:  RewriteConfig{StripPrefix: &keep},
+			target:   "/path1/items",
+			wantPath: "/path1/items",
+		},
+		{
+			name:     "replace prefix",
+			match:    RouteMatch{Path: "/api/"},
+			rewrite:  RewriteConfig{ReplacePrefix: "/v2/"},
+			target:   "/api/items",
+			wantPath: "/v2/items",
+		},
+		{
+			name:     "replace prefix on exact prefix",
+			match:    RouteMatch{Path: "/api"},
+			rewrite:  RewriteConfig{ReplacePrefix: "/v2"},
+			target:   "/api",
+			wantPath: "/v2",
+		},
+		{
+			name:        "keep raw path encoding",
+			match:       RouteMatch{Path: "/files"},
+			target:      "/files/a%2Fb",
+			wantPath:    "/a/b",
+			wantRawPath: "/a%2Fb",
+		},
+		{
+			name:     "regex route captures",
+			match:    RouteMatch{Path: "^/users/([0-9]+)/profile$", PathType: PathRegex},
+			rewrite:  RewriteConfig{Replacement: "/profiles/$1"},
+			target:   "/users/42/profile",
+			wantPath: "/profiles/42",
+		},
+		{
+			name:     "regex rewrite with named capture",
+			match:    RouteMatch{Path: "/shop"},
+			rewrite:  RewriteConfig{Regex: "^/shop/(?P<item>[a-z]+)$", Replacement: "/items/${item}"},
+			target:   "/shop/book",
+			wantPath: "/items/book",
+		},
+		{
+			name:     "exact route keeps path",
+			match:    RouteMatch{Path: "/status", PathType: PathExact},
+			target:   "/status",
+			wantPath: "/status",
+		},
+		{
+			name:     "host rewrite",
+			match:    RouteMatch{Path: "/"},
+			rewrite:  RewriteConfig{StripPrefix: &keep, Host: "backend.internal"},
+			target:   "/index.html",
+			wantPath: "/index.html",
+			wantHost: "backend.internal",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := compileRouteMatch(tt.match)
+			assert.NoError(t, err)
+			rw, err := compileRewrite(tt.rewrite, match)
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest("GET", "http://example.com"+tt.target, nil)
+			assert.True(t, match.matches(req), "Expected route to match %s", tt.target)
+
+			rw.rewrite(req, match)
+
+			assert.Equal(t, tt.wantPath, req.URL.Path)
+			assert.Equal(t, tt.wantRawPath, req.URL.RawPath)
+			if tt.wantHost != "" {
+				assert.Equal(t, tt.wantHost, req.Host)
+			} else {
+				assert.Equal(t, "example.com", req.Host)
+			}
+		})
+	}
+}
+
+func TestCompileRewrite_Invalid(t *testing.T) {
+	match, err := compileRouteMatch(RouteMatch{Path: "/"})
+	assert.NoError(t, err)
+
+	_, err = compileRewrite(RewriteConfig{Replacement: "/x/$1"}, match)
+	assert.Error(t, err, "Expected replacement without regex to fail")
+
+	_, err = compileRewrite(RewriteConfig{Regex: "(", Replacement: "/x"}, match)
+	assert.Error(t, err, "Expected invalid regex to fail")
+}
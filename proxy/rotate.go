@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A failed rotation is tried again after this long, writes in between go
+// to the current file
+const rotateRetryInterval = 10 * time.Second
+
+// rotatingFile is a log file that is moved aside once it grows past maxSize
+// or gets older than maxAge. Only the newest maxBackups old files are kept.
+type rotatingFile struct {
+	path       string
+	maxSize    int64         // 0 never rotates on size
+	maxAge     time.Duration // 0 never rotates on time
+	maxBackups int           // 0 keeps every old file
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	failed time.Time // last failed rotation, zero while rotation works
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	due := (f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize && f.size > 0) ||
+		(f.maxAge > 0 && time.Since(f.opened) >= f.maxAge)
+	if due && (f.failed.IsZero() || time.Since(f.failed) >= rotateRetryInterval) {
+		if err := f.rotate(); err != nil {
+			// keep writing to the current file, only the first failure
+			// is logged
+			if f.failed.IsZero() {
+				log.Printf("Rotating %s fail, retrying every %v: %v", f.path, rotateRetryInterval, err)
+			}
+			f.failed = time.Now()
+		} else {
+			f.failed = time.Time{}
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and opens a new one, f.mu must be
+// held. On error the current file stays open at its path.
+func (f *rotatingFile) rotate() error {
+	backup := fmt.Sprintf("%s.%s", f.path, time.Now().Format("20060102-150405.000000000"))
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	current := f.file
+	if err := f.open(); err != nil {
+		os.Rename(backup, f.path)
+		return err
+	}
+	current.Close()
+
+	if f.maxBackups > 0 {
+		// the timestamp suffix sorts oldest first
+		backups, _ := filepath.Glob(f.path + ".*")
+		sort.Strings(backups)
+		for len(backups) > f.maxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
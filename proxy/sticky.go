@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultStickyCookie = "GRP_AFFINITY"
+
+var (
+	processStickyKey     []byte
+	processStickyKeyOnce sync.Once
+)
+
+// defaultStickyKey returns a random signing key shared by every route of the
+// process, so affinity survives config reloads but not restarts
+func defaultStickyKey() []byte {
+	processStickyKeyOnce.Do(func() {
+		processStickyKey = make([]byte, 32)
+		rand.Read(processStickyKey)
+	})
+	return processStickyKey
+}
+
+// stickySession pins a client to an upstream server with a signed cookie
+type stickySession struct {
+	cookieName string
+	ttl        time.Duration
+	sameSite   http.SameSite
+	secure     bool
+	key        []byte
+}
+
+func newStickySession(cfg StickyConfig) *stickySession {
+	s := &stickySession{
+		cookieName: cfg.Cookie,
+		ttl:        cfg.TTL,
+		sameSite:   parseSameSite(cfg.SameSite),
+		secure:     cfg.Secure,
+		key:        []byte(cfg.Key),
+	}
+
+	if s.cookieName == "" {
+		s.cookieName = defaultStickyCookie
+	}
+	if len(s.key) == 0 {
+		s.key = defaultStickyKey()
+	}
+	// browsers drop SameSite=None cookies that are not secure
+	if s.sameSite == http.SameSiteNoneMode {
+		s.secure = true
+	}
+
+	return s
+}
+
+func parseSameSite(sameSite string) http.SameSite {
+	switch strings.ToLower(sameSite) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// serverID names a server in the cookie without exposing its URL
+func serverID(server *UpstreamServer) string {
+	sum := sha256.Sum256([]byte(server.URL.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *stickySession) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cookieServerID returns the server ID of a valid, unexpired cookie
+func (s *stickySession) cookieServerID(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(s.cookieName)
+	if err != nil {
+		return "", false
+	}
+
+	// id.expiry.signature
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(s.sign(payload)), []byte(parts[2])) {
+		return "", false
+	}
+
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || (expiry != 0 && time.Now().Unix() > expiry) {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+// lookup returns the alive server named by the request cookie, if any
+func (s *stickySession) lookup(r *http.Request, servers []*UpstreamServer) *UpstreamServer {
+	id, ok := s.cookieServerID(r)
+	if !ok {
+		return nil
+	}
+
+	for _, server := range getAliveServers(servers) {
+		if serverID(server) == id {
+			return server
+		}
+	}
+	return nil
+}
+
+// cookie returns the affinity cookie for server, or nil when the request
+// already carries a valid one for it
+func (s *stickySession) cookie(r *http.Request, server *UpstreamServer) *http.Cookie {
+	id := serverID(server)
+	if current, ok := s.cookieServerID(r); ok && current == id {
+		return nil
+	}
+
+	var expiry int64
+	if s.ttl > 0 {
+		expiry = time.Now().Add(s.ttl).Unix()
+	}
+	payload := id + "." + strconv.FormatInt(expiry, 10)
+
+	cookie := &http.Cookie{
+		Name:     s.cookieName,
+		Value:    payload + "." + s.sign(payload),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: s.sameSite,
+	}
+	if s.ttl > 0 {
+		cookie.MaxAge = int(s.ttl.Seconds())
+	}
+	return cookie
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadBalancer_StickySession(t *testing.T) {
+	servers := newTestUpstreams(3)
+	lb := NewLoadBalancer(servers, RoundRobin)
+	lb.SetStickySession(StickyConfig{Cookie: "affinity", TTL: time.Hour, SameSite: "strict", Key: "secret"})
+
+	// first request picks a server and gets a cookie for it
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	first := lb.GetNextServer(req)
+	cookie := lb.AffinityCookie(req, first)
+	assert.NotNil(t, cookie, "Expected an affinity cookie on the first request")
+	assert.Equal(t, "affinity", cookie.Name)
+	assert.Equal(t, 3600, cookie.MaxAge)
+	assert.Equal(t, http.SameSiteStrictMode, cookie.SameSite)
+	assert.True(t, cookie.HttpOnly)
+	assert.NotContains(t, cookie.Value, "localhost", "Expected the cookie not to expose the upstream URL")
+
+	// later requests with the cookie stick to that server and keep the cookie
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.AddCookie(cookie)
+		server := lb.GetNextServer(req)
+		assert.Same(t, first, server)
+		assert.Nil(t, lb.AffinityCookie(req, server), "Expected no new cookie while it is valid")
+	}
+
+	// a tampered cookie is ignored
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.AddCookie(&http.Cookie{Name: "affinity", Value: serverID(servers[0]) + ".0.forged"})
+	_, ok := lb.sticky.cookieServerID(req)
+	assert.False(t, ok, "Expected a forged cookie to be rejected")
+
+	// when the server goes down the base strategy picks another one and the cookie is reissued
+	first.SetAlive(false)
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.AddCookie(cookie)
+	server := lb.GetNextServer(req)
+	assert.NotSame(t, first, server)
+	reissued := lb.AffinityCookie(req, server)
+	assert.NotNil(t, reissued, "Expected the cookie to be reissued")
+	assert.NotEqual(t, cookie.Value, reissued.Value)
+}
+
+func TestStickySession_Expired(t *testing.T) {
+	servers := newTestUpstreams(1)
+	s := newStickySession(StickyConfig{TTL: time.Second, Key: "secret"})
+
+	payload := serverID(servers[0]) + ".1"
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.AddCookie(&http.Cookie{Name: defaultStickyCookie, Value: payload + "." + s.sign(payload)})
+
+	assert.Nil(t, s.lookup(req, servers), "Expected an expired cookie to be ignored")
+}
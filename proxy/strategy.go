@@ -13,14 +13,22 @@ const (
 	LeastConnections Strategy = "least-connections"
 	IPHash           Strategy = "ip-hash"
 	WeightedRR       Strategy = "weighted-round-robin"
+	ConsistentHash   Strategy = "consistent-hash"
 )
 
 type StrategyHandler interface {
-	NextServer(servers []*UpstreamServer, remoteAddr string) *UpstreamServer
+	// key is the remote address, or the configured hash key for consistent hashing
+	NextServer(servers []*UpstreamServer, key string) *UpstreamServer
 	IncrementConnections(server *UpstreamServer)
 	DecrementConnections(server *UpstreamServer)
 }
 
+// skippingStrategy is a strategy that keeps state built from every server,
+// so servers already tried are skipped instead of left out of servers
+type skippingStrategy interface {
+	nextServerSkipping(servers []*UpstreamServer, key string, skip map[*UpstreamServer]bool) *UpstreamServer
+}
+
 type BaseStrategy struct {
 	mu      sync.RWMutex
 	counter uint32
@@ -42,6 +50,11 @@ type WeightedRoundRobinStrategy struct {
 	BaseStrategy
 }
 
+type ConsistentHashStrategy struct {
+	BaseStrategy
+	ring *hashRing
+}
+
 func NewStrategy(strategyType Strategy) StrategyHandler {
 	switch strategyType {
 	case RoundRobin:
@@ -52,22 +65,36 @@ func NewStrategy(strategyType Strategy) StrategyHandler {
 		return &IPHashStrategy{}
 	case WeightedRR:
 		return &WeightedRoundRobinStrategy{}
+	case ConsistentHash:
+		return &ConsistentHashStrategy{}
 	default:
 		return &RoundRobinStrategy{}
 	}
 }
 
-// get the alive server
+// get the alive server, skipping servers ejected by outlier detection,
+// behind an open circuit or at max_conns
 func getAliveServers(servers []*UpstreamServer) []*UpstreamServer {
 	var alive []*UpstreamServer
-	for _, server := range servers {
-		if server.Alive {
+	for _, server := range getHealthyServers(servers) {
+		if server.hasCapacity() {
 			alive = append(alive, server)
 		}
 	}
 	return alive
 }
 
+// getHealthyServers is getAliveServers ignoring max_conns
+func getHealthyServers(servers []*UpstreamServer) []*UpstreamServer {
+	var healthy []*UpstreamServer
+	for _, server := range servers {
+		if server.IsAlive() && !server.Ejected() && server.circuitAvailable() {
+			healthy = append(healthy, server)
+		}
+	}
+	return healthy
+}
+
 // 輪詢策略
 func (s *RoundRobinStrategy) NextServer(servers []*UpstreamServer, _ string) *UpstreamServer {
 	aliveServer := getAliveServers(servers)
@@ -129,11 +156,12 @@ func (s *WeightedRoundRobinStrategy) NextServer(servers []*UpstreamServer, _ str
 
 	// First pass - calculate total weight and find highest weight server
 	for _, server := range alive {
-		totalWeight += server.Weight
-		server.CurrentWeight += server.Weight
+		weight := atomic.LoadInt32(&server.Weight)
+		totalWeight += weight
+		currentWeight := atomic.AddInt32(&server.CurrentWeight, weight)
 
-		if server.CurrentWeight > maxWeight {
-			maxWeight = server.CurrentWeight
+		if currentWeight > maxWeight {
+			maxWeight = currentWeight
 			maxServer = server
 		}
 	}
@@ -143,11 +171,45 @@ func (s *WeightedRoundRobinStrategy) NextServer(servers []*UpstreamServer, _ str
 	}
 
 	// Decrease current weight
-	maxServer.CurrentWeight -= totalWeight
+	atomic.AddInt32(&maxServer.CurrentWeight, -totalWeight)
 
 	return maxServer
 }
 
+// 一致性雜湊策略
+func (s *ConsistentHashStrategy) NextServer(servers []*UpstreamServer, key string) *UpstreamServer {
+	return s.nextServerSkipping(servers, key, nil)
+}
+
+// nextServerSkipping walks the ring from the owner of key past the servers
+// in skip. Skipped servers and servers at max_conns stay on the ring so it
+// is not rebuilt on every retry or as servers fill up, their keys go to the
+// next server instead.
+func (s *ConsistentHashStrategy) nextServerSkipping(servers []*UpstreamServer, key string, skip map[*UpstreamServer]bool) *UpstreamServer {
+	healthy := getHealthyServers(servers)
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	s.mu.RLock()
+	ring := s.ring
+	s.mu.RUnlock()
+
+	// rebuild only when membership or weights changed
+	if ring == nil || !ring.matches(healthy) {
+		s.mu.Lock()
+		if s.ring == nil || !s.ring.matches(healthy) {
+			s.ring = newHashRing(healthy)
+		}
+		ring = s.ring
+		s.mu.Unlock()
+	}
+
+	return ring.next(key, func(server *UpstreamServer) bool {
+		return !skip[server] && server.hasCapacity()
+	})
+}
+
 // Helper functions for server management
 func (s *BaseStrategy) UpdateWeight(server *UpstreamServer, weight int32) {
 	atomic.StoreInt32(&server.Weight, weight)
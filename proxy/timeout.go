@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Tags of the timeout that ended a request, used in the 504 log lines
+const (
+	TimeoutDial           = "dial"
+	TimeoutTLSHandshake   = "tls_handshake"
+	TimeoutResponseHeader = "response_header"
+	TimeoutPerTry         = "per_try"
+	TimeoutRequest        = "request"
+	TimeoutStreamIdle     = "stream_idle"
+	TimeoutUpstream       = "upstream" // any other timeout reported by the transport
+)
+
+// errRequestTimeout is the cause of a request context cancelled by the
+// total request timeout
+var errRequestTimeout = errors.New("request timeout")
+
+// validate checks that no timeout is negative
+func (t ListenerTimeouts) validate() error {
+	for name, d := range map[string]time.Duration{
+		"read_header": t.ReadHeader,
+		"read":        t.Read,
+		"write":       t.Write,
+		"idle":        t.Idle,
+	} {
+		if d < 0 {
+			return fmt.Errorf("timeout %s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// validate checks that no timeout is negative
+func (t RouteTimeouts) validate() error {
+	for name, d := range map[string]time.Duration{
+		TimeoutDial:           t.Dial,
+		TimeoutTLSHandshake:   t.TLSHandshake,
+		TimeoutResponseHeader: t.ResponseHeader,
+		TimeoutRequest:        t.Request,
+		TimeoutStreamIdle:     t.StreamIdle,
+	} {
+		if d < 0 {
+			return fmt.Errorf("timeout %s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// applyTimeouts sets the connect timeouts of cfg on transport, empty fields
+// keep the defaults
+func applyTimeouts(transport *http.Transport, cfg RouteTimeouts) {
+	if cfg.Dial > 0 {
+		dialer := &net.Dialer{Timeout: cfg.Dial, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+	}
+	if cfg.TLSHandshake > 0 {
+		transport.TLSHandshakeTimeout = cfg.TLSHandshake
+	}
+	transport.ResponseHeaderTimeout = cfg.ResponseHeader
+}
+
+// attemptTransport sends a request with the transport of the route serving
+// it. The transport can't live on the upstream server's ReverseProxy, as
+// upstream servers are shared across reloads.
+type attemptTransport struct{}
+
+func (attemptTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if at := attemptFrom(r.Context()); at != nil && at.transport != nil {
+		return at.transport.RoundTrip(r)
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// timeoutKind returns the tag of the timeout behind err, or "" when err is
+// not a timeout
+func timeoutKind(r *http.Request, err error) string {
+	if errors.Is(context.Cause(r.Context()), errRequestTimeout) {
+		return TimeoutRequest
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout() {
+		return TimeoutDial
+	}
+
+	// the transport reports these as plain net.Errors
+	switch {
+	case strings.Contains(err.Error(), "TLS handshake timeout"):
+		return TimeoutTLSHandshake
+	case strings.Contains(err.Error(), "timeout awaiting response headers"):
+		return TimeoutResponseHeader
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return TimeoutUpstream
+	}
+	return ""
+}
+
+// idleTimeoutBody cancels the attempt when the upstream sends nothing for
+// timeout while the response body is being read. The response has already
+// started then, so the client connection is aborted instead of getting a 504.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, timeout: timeout}
+	b.timer = time.AfterFunc(timeout, func() {
+		log.Printf("代理逾時 [%s]: no data from upstream for %v", TimeoutStreamIdle, timeout)
+		cancel()
+	})
+	// only the time spent waiting on the upstream counts
+	b.timer.Stop()
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
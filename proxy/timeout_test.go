@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyServer_Timeouts(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	t.Run("response header", func(t *testing.T) {
+		proxyServer, err := NewProxyServer([]string{slow.URL})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		defer proxyServer.Stop()
+		proxyServer.SetTimeouts(RouteTimeouts{ResponseHeader: 20 * time.Millisecond})
+
+		rr := httptest.NewRecorder()
+		proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+		assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	})
+
+	t.Run("total request", func(t *testing.T) {
+		proxyServer := newRetryProxy(t, RetryConfig{Attempts: 5, On: []string{RetryOnTimeout}, PerTryTimeout: 30 * time.Millisecond}, slow.URL)
+		proxyServer.SetTimeouts(RouteTimeouts{Request: 50 * time.Millisecond})
+
+		start := time.Now()
+		rr := httptest.NewRecorder()
+		proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+		assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+		assert.Less(t, time.Since(start), 500*time.Millisecond, "Expected retries to stop at the request timeout")
+	})
+}
+
+func TestProxyServer_TimeoutAfterAcquire(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	proxyServer, err := NewProxyServer([]string{upstream.URL})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	proxyServer.SetMaxConns(1, nil)
+	server := proxyServer.LoadBalancer.servers[0]
+
+	// the request timeout fired before the connection was taken
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errRequestTimeout)
+	rr := httptest.NewRecorder()
+	proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil).WithContext(ctx))
+
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&server.ActiveConns), "Expected the connection given back")
+}
+
+func TestProxyServer_StreamIdleTimeout(t *testing.T) {
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer stalled.Close()
+
+	proxyServer, err := NewProxyServer([]string{stalled.URL})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	proxyServer.SetTimeouts(RouteTimeouts{StreamIdle: 30 * time.Millisecond})
+
+	// the response has started, so the body is cut off instead
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "partial", rr.Body.String())
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestIdleTimeoutBody(t *testing.T) {
+	var cancelled atomic.Bool
+	pr, pw := io.Pipe()
+	body := newIdleTimeoutBody(pr, 20*time.Millisecond, func() {
+		cancelled.Store(true)
+		pw.Close()
+	})
+
+	// time between reads does not count
+	go pw.Write([]byte("a"))
+	buf := make([]byte, 1)
+	_, err := body.Read(buf)
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, cancelled.Load())
+
+	// waiting on the upstream does
+	_, err = body.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, cancelled.Load())
+	body.Close()
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Session ticket keys are rotated at most this often, and the keys of the
+// last rotations keep resuming sessions
+const (
+	minTicketKeyRotation = time.Minute
+	ticketKeysKept       = 3
+)
+
+// HSTS max-age when none is set, also the least the preload list accepts
+const defaultHSTSMaxAge = 365 * 24 * time.Hour
+
+// Curves by their config name
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// ALPN protocols the http.Server can serve
+var alpnProtocols = map[string]bool{
+	"h2":       true,
+	"http/1.1": true,
+}
+
+// tlsPolicy is the compiled TLS policy of a listener
+type tlsPolicy struct {
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+	nextProtos   []string
+	ticketsOff   bool
+	tickets      *ticketKeys // nil leaves the rotation to Go
+
+	mu   sync.Mutex
+	base *tls.Config
+	tls  *tls.Config
+}
+
+// ticketKeys rotates the session ticket keys of a listener. Every config
+// handed out for a handshake gets the current keys before it is used.
+type ticketKeys struct {
+	period time.Duration
+
+	mu      sync.Mutex
+	keys    [][32]byte
+	rotated time.Time
+	applied map[*tls.Config]bool
+}
+
+func newTLSPolicy(cfg TLSPolicy) (*tlsPolicy, error) {
+	minVersion, err := parseTLSVersion(cfg.MinVersion, tls.VersionTLS12)
+	if err != nil {
+		return nil, fmt.Errorf("tls: min_version: %v", err)
+	}
+	maxVersion, err := parseTLSVersion(cfg.MaxVersion, tls.VersionTLS13)
+	if err != nil {
+		return nil, fmt.Errorf("tls: max_version: %v", err)
+	}
+	if minVersion > maxVersion {
+		return nil, fmt.Errorf("tls: min_version %s is above max_version %s", cfg.MinVersion, cfg.MaxVersion)
+	}
+
+	p := &tlsPolicy{minVersion: minVersion, maxVersion: maxVersion}
+
+	for _, name := range cfg.CipherSuites {
+		id, err := cipherSuiteID(name)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %v", err)
+		}
+		p.cipherSuites = append(p.cipherSuites, id)
+	}
+	for _, name := range cfg.Curves {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("tls: unknown curve %q", name)
+		}
+		p.curves = append(p.curves, id)
+	}
+
+	if len(cfg.ALPN) > 0 {
+		for _, proto := range cfg.ALPN {
+			if !alpnProtocols[proto] {
+				return nil, fmt.Errorf("tls: unsupported alpn protocol %q", proto)
+			}
+			p.nextProtos = append(p.nextProtos, proto)
+		}
+		// TLS-ALPN-01 challenges must keep working
+		p.nextProtos = append(p.nextProtos, acme.ALPNProto)
+	}
+
+	p.ticketsOff = cfg.SessionTickets != nil && !*cfg.SessionTickets
+	if cfg.TicketKeyRotation != 0 {
+		if p.ticketsOff {
+			return nil, fmt.Errorf("tls: ticket_key_rotation needs session tickets")
+		}
+		if cfg.TicketKeyRotation < minTicketKeyRotation {
+			return nil, fmt.Errorf("tls: ticket_key_rotation must be at least %v", minTicketKeyRotation)
+		}
+		p.tickets = &ticketKeys{period: cfg.TicketKeyRotation}
+	}
+
+	return p, nil
+}
+
+// cipherSuiteID looks up a secure TLS 1.2 cipher suite by its crypto/tls
+// name. TLS 1.3 suites can't be configured.
+func cipherSuiteID(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name != name {
+			continue
+		}
+		for _, v := range suite.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				return suite.ID, nil
+			}
+		}
+		return 0, fmt.Errorf("cipher suite %s is TLS 1.3 only and not configurable", name)
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+// tlsConfig returns base with the policy applied, built once per base
+func (p *tlsPolicy) tlsConfig(base *tls.Config) *tls.Config {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.base != base {
+		config := base.Clone()
+		config.MinVersion = p.minVersion
+		config.MaxVersion = p.maxVersion
+		config.CipherSuites = p.cipherSuites
+		config.CurvePreferences = p.curves
+		config.SessionTicketsDisabled = p.ticketsOff
+		if p.nextProtos != nil {
+			config.NextProtos = p.nextProtos
+		}
+		p.base, p.tls = base, config
+	}
+	return p.tls
+}
+
+// apply sets the current keys on config, rotating them first when the
+// period passed
+func (tk *ticketKeys) apply(config *tls.Config) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	if tk.keys == nil || time.Since(tk.rotated) >= tk.period {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return
+		}
+		tk.keys = append([][32]byte{key}, tk.keys...)
+		if len(tk.keys) > ticketKeysKept {
+			tk.keys = tk.keys[:ticketKeysKept]
+		}
+		tk.rotated = time.Now()
+		tk.applied = make(map[*tls.Config]bool)
+	}
+
+	if !tk.applied[config] {
+		config.SetSessionTicketKeys(tk.keys)
+		tk.applied[config] = true
+	}
+}
+
+func (cfg HSTSConfig) validate() error {
+	if cfg.MaxAge < 0 {
+		return fmt.Errorf("hsts: max_age must not be negative")
+	}
+	if cfg.Preload && (!cfg.IncludeSubdomains || cfg.maxAge() < defaultHSTSMaxAge) {
+		return fmt.Errorf("hsts: preload needs include_subdomains and a max_age of at least %v", defaultHSTSMaxAge)
+	}
+	return nil
+}
+
+func (cfg HSTSConfig) maxAge() time.Duration {
+	if cfg.MaxAge == 0 {
+		return defaultHSTSMaxAge
+	}
+	return cfg.MaxAge
+}
+
+// headerRules sets the Strict-Transport-Security header on responses
+func (cfg HSTSConfig) headerRules() *HeaderRules {
+	value := "max-age=" + strconv.FormatInt(int64(cfg.maxAge()/time.Second), 10)
+	if cfg.IncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if cfg.Preload {
+		value += "; preload"
+	}
+	return &HeaderRules{Set: map[string]string{"Strict-Transport-Security": value}}
+}
+
+func (cfg HTTPRedirectConfig) validate() error {
+	switch cfg.Code {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("http_redirect: unsupported code %d", cfg.Code)
+	}
+	if cfg.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+			return fmt.Errorf("http_redirect: invalid listen %q", cfg.Listen)
+		}
+	}
+	return nil
+}
+
+func (cfg HTTPRedirectConfig) code() int {
+	if cfg.Code == 0 {
+		return http.StatusPermanentRedirect
+	}
+	return cfg.Code
+}
+
+// RedirectHandler sends plain HTTP requests for the names of TLS servers to
+// the HTTPS listener serving them, other names get a 404. It is nil when
+// http_redirect is not configured, which leaves the redirect to autocert.
+func (cl *ConfigLoader) RedirectHandler() http.Handler {
+	cl.mu.Lock()
+	redirect := cl.Config.HTTPRedirect
+	certs := cl.certs
+	cl.mu.Unlock()
+
+	if redirect == nil || certs == nil {
+		return nil
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		port, ok := certs.httpsPort(r.Host)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		host := stripPort(r.Host)
+		if port != "443" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), redirect.code())
+	})
+}
+
+// httpsPort returns the port of the TLS listener serving host, 443 when
+// several do
+func (s *certStore) httpsPort(host string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ports []string
+	for listen, cr := range s.listeners {
+		if _, ok := cr.match(host); !ok {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(listen); err == nil {
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) == 0 {
+		return "", false
+	}
+
+	sort.Strings(ports)
+	for _, port := range ports {
+		if port == "443" {
+			return port, true
+		}
+	}
+	return ports[0], true
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSPolicy_Handshake(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestCert(t, dir, "server", "a.example.com")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=60")
+	}))
+	defer upstream.Close()
+
+	route := []RouteConfig{{Match: RouteMatch{Path: "/"}, Proxy: ProxyConfig{Upstream: []string{upstream.URL}}}}
+	cl := &ConfigLoader{Config: &Config{Servers: []ServerConfig{{
+		Listen: ":443", Ssl: true, Host: "a.example.com", Default: true,
+		CertFile: certPath, KeyFile: keyPath, Routes: route,
+		TLS: &TLSPolicy{
+			MaxVersion:        "1.2",
+			CipherSuites:      []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+			Curves:            []string{"P-256"},
+			ALPN:              []string{"http/1.1"},
+			TicketKeyRotation: time.Hour,
+		},
+		HSTS: &HSTSConfig{IncludeSubdomains: true},
+	}}}}
+	assert.NoError(t, cl.Config.Validate())
+	proxyServers, err := cl.CreateProxyServers()
+	assert.NoError(t, err)
+	defer cl.Stop()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &http.Server{Handler: proxyServers[":443"].HttpHandler, TLSConfig: cl.TLSConfig(":443", nil)}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	_, err = tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "a.example.com", InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})
+	assert.Error(t, err, "Expected TLS 1.3 refused above max_version")
+
+	cache := tls.NewLRUClientSessionCache(1)
+	dial := func() tls.ConnectionState {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			ServerName:         "a.example.com",
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2", "http/1.1"},
+			ClientSessionCache: cache,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState()
+	}
+
+	state := dial()
+	assert.Equal(t, uint16(tls.VersionTLS12), state.Version)
+	assert.Equal(t, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, state.CipherSuite)
+	assert.Equal(t, "http/1.1", state.NegotiatedProtocol, "Expected h2 left out of alpn")
+	assert.True(t, dial().DidResume, "Expected the rotated ticket keys to resume sessions")
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{ServerName: "a.example.com", InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, []string{"max-age=31536000; includeSubDomains"}, resp.Header.Values("Strict-Transport-Security"), "Expected the upstream header replaced")
+	}
+}
+
+func TestTicketKeys_Rotate(t *testing.T) {
+	tk := &ticketKeys{period: time.Hour}
+	config := &tls.Config{}
+
+	tk.apply(config)
+	tk.apply(config)
+	assert.Len(t, tk.keys, 1)
+	first := tk.keys[0]
+
+	for i := 0; i < 4; i++ {
+		tk.rotated = tk.rotated.Add(-time.Hour)
+		tk.apply(config)
+	}
+	assert.Len(t, tk.keys, ticketKeysKept, "Expected only the last keys kept")
+	assert.NotEqual(t, first, tk.keys[0], "Expected a new key first")
+	assert.True(t, tk.applied[config])
+}
+
+func TestRedirectHandler(t *testing.T) {
+	route := []RouteConfig{{Match: RouteMatch{Path: "/"}, Proxy: ProxyConfig{Upstream: []string{"http://localhost:8081"}}}}
+	cl := &ConfigLoader{Config: &Config{
+		Servers: []ServerConfig{
+			{Listen: ":443", Ssl: true, Host: "a.example.com", Routes: route},
+			{Listen: ":8443", Ssl: true, Host: "*.b.example.com", Routes: route},
+			{Listen: ":8080", Host: "c.example.com", Routes: route},
+		},
+	}}
+	_, err := cl.CreateProxyServers()
+	assert.NoError(t, err)
+	defer cl.Stop()
+
+	assert.Nil(t, cl.RedirectHandler(), "Expected autocert to redirect without http_redirect")
+
+	cl.Config.HTTPRedirect = &HTTPRedirectConfig{}
+	handler := cl.RedirectHandler()
+
+	tests := []struct {
+		target   string
+		code     int
+		location string
+	}{
+		{"http://a.example.com/path?q=1", http.StatusPermanentRedirect, "https://a.example.com/path?q=1"},
+		{"http://www.b.example.com:80/", http.StatusPermanentRedirect, "https://www.b.example.com:8443/"},
+		{"http://c.example.com/", http.StatusNotFound, ""},
+		{"http://evil.example.com/", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", tt.target, nil))
+		assert.Equal(t, tt.code, rec.Code, tt.target)
+		assert.Equal(t, tt.location, rec.Header().Get("Location"), tt.target)
+	}
+}
+
+func TestValidate_TLSPolicy(t *testing.T) {
+	off := false
+	route := []RouteConfig{{Match: RouteMatch{Path: "/"}, Proxy: ProxyConfig{Upstream: []string{"http://localhost:8081"}}}}
+	server := func(policy *TLSPolicy) ServerConfig {
+		return ServerConfig{Listen: ":443", Ssl: true, Host: "a.example.com", TLS: policy, Routes: route}
+	}
+
+	valid := &Config{Servers: []ServerConfig{server(&TLSPolicy{
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+		Curves:       []string{"X25519", "P-384"},
+		ALPN:         []string{"h2", "http/1.1"},
+	})}}
+	assert.NoError(t, valid.Validate())
+
+	for name, policy := range map[string]*TLSPolicy{
+		"unknown version": {MinVersion: "2.0"},
+		"min above max":   {MinVersion: "1.3", MaxVersion: "1.2"},
+		"insecure suite":  {CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		"TLS 1.3 suite":   {CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		"unknown suite":   {CipherSuites: []string{"TLS_FOO"}},
+		"unknown curve":   {Curves: []string{"P-224"}},
+		"unknown alpn":    {ALPN: []string{"h3"}},
+		"short rotation":  {TicketKeyRotation: time.Second},
+		"tickets off":     {SessionTickets: &off, TicketKeyRotation: time.Hour},
+	} {
+		cfg := &Config{Servers: []ServerConfig{server(policy)}}
+		assert.Error(t, cfg.Validate(), name)
+	}
+
+	plain := server(&TLSPolicy{})
+	plain.Ssl = false
+	assert.Error(t, (&Config{Servers: []ServerConfig{plain}}).Validate(), "Expected tls to need ssl")
+
+	other := server(&TLSPolicy{MinVersion: "1.3"})
+	other.Host = "b.example.com"
+	shared := &Config{Servers: []ServerConfig{server(&TLSPolicy{}), other}}
+	assert.Error(t, shared.Validate(), "Expected conflicting policies on one listener rejected")
+
+	hsts := server(nil)
+	hsts.HSTS = &HSTSConfig{Preload: true}
+	assert.Error(t, (&Config{Servers: []ServerConfig{hsts}}).Validate(), "Expected preload to need include_subdomains")
+	hsts.HSTS = &HSTSConfig{Preload: true, IncludeSubdomains: true}
+	assert.NoError(t, (&Config{Servers: []ServerConfig{hsts}}).Validate())
+	assert.Equal(t, "max-age=31536000; includeSubDomains; preload", hsts.HSTS.headerRules().Set["Strict-Transport-Security"])
+
+	redirect := &Config{Servers: []ServerConfig{server(nil)}, HTTPRedirect: &HTTPRedirectConfig{Code: http.StatusOK}}
+	assert.Error(t, redirect.Validate(), "Expected only redirect codes")
+
+	redirect.HTTPRedirect = &HTTPRedirectConfig{Listen: ":8080"}
+	redirect.ACME = &ACMEConfig{HTTPChallenge: &off}
+	assert.NoError(t, redirect.Validate())
+	assert.Equal(t, ":8080", redirect.ChallengeAddress(), "Expected the redirect listener without HTTP-01")
+
+	redirect.ACME = &ACMEConfig{}
+	assert.Error(t, redirect.Validate(), "Expected one listener for challenges and redirects")
+}
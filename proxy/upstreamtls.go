@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// TLS versions by their config name
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion returns the version named v, def when v is empty
+func parseTLSVersion(v string, def uint16) (uint16, error) {
+	if v == "" {
+		return def, nil
+	}
+	version, ok := tlsVersions[v]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", v)
+	}
+	return version, nil
+}
+
+// newUpstreamTLS builds the client side TLS config of a route
+func newUpstreamTLS(cfg UpstreamTLSConfig) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(cfg.MinVersion, tls.VersionTLS12)
+	if err != nil {
+		return nil, fmt.Errorf("upstream_tls: %v", err)
+	}
+
+	config := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         minVersion,
+	}
+
+	if len(cfg.CAFiles) > 0 {
+		pool, err := loadCertPool(cfg.CAFiles...)
+		if err != nil {
+			return nil, fmt.Errorf("upstream_tls: %v", err)
+		}
+		config.RootCAs = pool
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("upstream_tls: cert_file and key_file must be set together")
+	}
+	if cfg.CertFile != "" {
+		cert, err := loadKeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstream_tls: %v", err)
+		}
+		config.Certificates = []tls.Certificate{*cert}
+	}
+
+	return config, nil
+}
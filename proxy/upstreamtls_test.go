@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serverCert signs a server certificate for names
+func (ca *testCA) serverCert(t *testing.T, names ...string) tls.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeKeyPair writes cert to PEM files in dir
+func writeKeyPair(t *testing.T, dir, name string, cert tls.Certificate) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certPath, keyPath
+}
+
+func TestProxyServer_UpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+
+	// the upstream only talks to clients with a certificate from the CA
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	pool, _ := loadCertPool(ca.path)
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, "upstream.internal")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	certPath, keyPath := writeKeyPair(t, dir, "client", ca.issue(t, 2, pkix.Name{CommonName: "proxy"}))
+	cfg := UpstreamTLSConfig{
+		CAFiles:    []string{ca.path},
+		CertFile:   certPath,
+		KeyFile:    keyPath,
+		ServerName: "upstream.internal",
+	}
+
+	proxyServer, err := NewProxyServer([]string{upstream.URL})
+	assert.NoError(t, err)
+	assert.NoError(t, proxyServer.SetUpstreamTLS(cfg))
+	proxyServer.SetTimeouts(RouteTimeouts{Dial: time.Second})
+	assert.NotNil(t, proxyServer.transport.TLSClientConfig, "Expected timeouts to keep the TLS settings")
+
+	rr := httptest.NewRecorder()
+	proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "proxy", rr.Body.String(), "Expected the client certificate presented upstream")
+
+	// health checks connect the same way
+	proxyServer.Config.HealthCheckInterval = 10 * time.Millisecond
+	proxyServer.Config.MaxFailCount = 1
+	proxyServer.Start(context.Background())
+	time.Sleep(50 * time.Millisecond)
+	proxyServer.Stop()
+	assert.True(t, proxyServer.LoadBalancer.servers[0].IsAlive(), "Expected health checks to pass with the route's TLS settings")
+
+	// without them the upstream's certificate is not trusted
+	plain, err := NewProxyServer([]string{upstream.URL})
+	assert.NoError(t, err)
+	rr = httptest.NewRecorder()
+	plain.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	plain.Config.HealthCheckInterval = 10 * time.Millisecond
+	plain.Config.MaxFailCount = 1
+	plain.Start(context.Background())
+	time.Sleep(50 * time.Millisecond)
+	plain.Stop()
+	assert.False(t, plain.LoadBalancer.servers[0].IsAlive())
+}
+
+func TestProxyServer_UpstreamTLSInsecure(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	proxyServer, err := NewProxyServer([]string{upstream.URL})
+	assert.NoError(t, err)
+	assert.NoError(t, proxyServer.SetUpstreamTLS(UpstreamTLSConfig{InsecureSkipVerify: true, MinVersion: "1.3"}))
+
+	rr := httptest.NewRecorder()
+	proxyServer.ServeHTTP(rr, httptest.NewRequest("GET", "http://localhost", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, uint16(tls.VersionTLS13), proxyServer.transport.TLSClientConfig.MinVersion)
+}
+
+func TestUpstreamTLSConfig_Validate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certPath, _ := writeTestCert(t, dir, "a", "a.example.com")
+	_, otherKey := writeTestCert(t, dir, "b", "b.example.com")
+
+	tests := []UpstreamTLSConfig{
+		{MinVersion: "1.4"},
+		{CAFiles: []string{filepath.Join(dir, "missing.pem")}},
+		{CertFile: certPath},
+		{CertFile: certPath, KeyFile: otherKey},
+	}
+	for i, cfg := range tests {
+		_, err := newUpstreamTLS(cfg)
+		assert.Error(t, err, "case %d", i)
+	}
+
+	config, err := newUpstreamTLS(UpstreamTLSConfig{CAFiles: []string{ca.path}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import "net/http"
+
+// responseRecorder remembers the status and size of a response while
+// passing it through. Unwrap lets http.ResponseController reach the
+// underlying writer for flushing and WebSocket hijacking.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w}
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	// informational responses are followed by the real one
+	informational := status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+	if rec.status == 0 && !informational {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Status returns the status sent to the client, 200 if nothing was written
+func (rec *responseRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}